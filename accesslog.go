@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// clfTime is the timestamp layout of the Common/Combined Log Formats
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// openAccessLog returns where ACCESS_LOG lines go: path opened for appending, or stdout when
+// path is empty
+func openAccessLog(path string) (io.Writer, error) {
+	if path == "" {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+}
+
+// accessLogMiddleware writes one Apache/NGINX Combined Log Format line per request to w, with
+// the request duration in seconds appended (as NGINX's $request_time), so standard log
+// analyzers can read it. It is independent of the structured request log.
+func accessLogMiddleware(w io.Writer) gin.HandlerFunc {
+	var mu sync.Mutex
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		user := "-"
+		if u, _, ok := c.Request.BasicAuth(); ok && u != "" {
+			user = clfQuote(u)
+		}
+		size := "-"
+		if n := c.Writer.Size(); n > 0 {
+			size = strconv.Itoa(n)
+		}
+		line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\" %.3f\n",
+			clientIP(c), user, start.Format(clfTime),
+			c.Request.Method, clfQuote(c.Request.RequestURI), c.Request.Proto,
+			c.Writer.Status(), size,
+			clfQuote(c.Request.Referer()), clfQuote(c.Request.UserAgent()),
+			time.Since(start).Seconds())
+		mu.Lock()
+		_, _ = io.WriteString(w, line)
+		mu.Unlock()
+	}
+}
+
+// clfQuote escapes quotes, backslashes and control bytes so a client-supplied field can't
+// break out of its quoted column or forge extra lines; empty fields become "-"
+func clfQuote(s string) string {
+	if s == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; {
+		case ch == '"' || ch == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case ch < 0x20 || ch == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", ch)
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicUser is the stored password hash of one BASIC_AUTH_USERS entry, a bcrypt hash
+// ($2a$/$2b$/$2y$, as written by htpasswd -B). Only bcrypt is accepted, all at one cost, so
+// that every check, for known and unknown users alike, costs the same bcrypt comparison.
+type basicUser struct {
+	bcrypt []byte
+	cost   int
+}
+
+// check compares password with the stored hash
+func (u basicUser) check(password string) bool {
+	return bcrypt.CompareHashAndPassword(u.bcrypt, []byte(password)) == nil
+}
+
+// parseBasicUsers reads "user:bcrypt-hash" entries into a map by user name. Hashes of different
+// costs are refused: checks against the cheaper ones would tell those users apart by timing.
+func parseBasicUsers(entries []string) (map[string]basicUser, error) {
+	users := make(map[string]basicUser, len(entries))
+	for _, e := range entries {
+		name, hash, ok := strings.Cut(e, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q is not user:hash", e)
+		}
+		if _, dup := users[name]; dup {
+			return nil, fmt.Errorf("duplicate user %q", name)
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, fmt.Errorf("user %q: hash is not bcrypt (generate one with htpasswd -nbB)", name)
+		}
+		for other, u := range users {
+			if u.cost != cost {
+				return nil, fmt.Errorf("user %q: bcrypt cost %d differs from user %q's %d; hash every password at the same cost (htpasswd -C)", name, cost, other, u.cost)
+			}
+			break
+		}
+		users[name] = basicUser{bcrypt: []byte(hash), cost: cost}
+	}
+	return users, nil
+}
+
+// dummyHash returns a bcrypt hash at the cost of users' hashes, compared against for unknown
+// user names so that a wrong name costs as much time as a wrong password
+func dummyHash(users map[string]basicUser) []byte {
+	cost := bcrypt.DefaultCost
+	for _, u := range users {
+		cost = u.cost
+		break
+	}
+	h, _ := bcrypt.GenerateFromPassword([]byte("ipcheck"), cost)
+	return h
+}
+
+// checkBasic validates the request's Basic credentials against users, returning the user name.
+// Unknown names are compared against dummy (see dummyHash).
+func checkBasic(c *gin.Context, users map[string]basicUser, dummy []byte) (string, bool) {
+	name, password, ok := c.Request.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	u, known := users[name]
+	if !known {
+		_ = bcrypt.CompareHashAndPassword(dummy, []byte(password))
+		return "", false
+	}
+	return name, u.check(password)
+}
+
+// principalKey is the gin context key under which apiKeyMiddleware records who authenticated:
+// "key:<sha256 of the API key>" or "user:<Basic user name>"
+const principalKey = "auth.principal"
+
+// principal identifies the client of c for per-client state such as idempotency keys: the
+// authenticated key or user, or the client IP when auth is disabled
+func principal(c *gin.Context) string {
+	if p := c.GetString(principalKey); p != "" {
+		return p
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// apiKeyMiddleware requires "Authorization: Bearer <key>" matching one of keys, or Basic
+// credentials of one of users, answering 401 otherwise. Returns nil when neither is configured
+// (auth disabled).
+func apiKeyMiddleware(keys []string, users map[string]basicUser) gin.HandlerFunc {
+	if len(keys) == 0 && len(users) == 0 {
+		return nil
+	}
+	// Compare fixed-size digests so neither key contents nor lengths leak through timing
+	sums := make([][32]byte, len(keys))
+	for i, k := range keys {
+		sums[i] = sha256.Sum256([]byte(k))
+	}
+	msg := "missing or invalid API key"
+	var dummy []byte
+	if len(users) > 0 {
+		msg = "missing or invalid credentials"
+		// Built here at startup, so the first unknown name doesn't pay for it
+		dummy = dummyHash(users)
+	}
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+		match := 0
+		for i := range sums {
+			match |= subtle.ConstantTimeCompare(sum[:], sums[i][:])
+		}
+		var who string
+		if ok && match == 1 {
+			who = "key:" + hex.EncodeToString(sum[:])
+		} else if len(users) > 0 {
+			if name, ok := checkBasic(c, users, dummy); ok {
+				who = "user:" + name
+			}
+		}
+		if who == "" {
+			if len(keys) > 0 {
+				c.Writer.Header().Add("WWW-Authenticate", `Bearer realm="ipcheck"`)
+			}
+			if len(users) > 0 {
+				c.Writer.Header().Add("WWW-Authenticate", `Basic realm="ipcheck", charset="UTF-8"`)
+			}
+			abortWithError(c, 401, msg)
+			return
+		}
+		c.Set(principalKey, who)
+		c.Next()
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicUsersShareOneCost(t *testing.T) {
+	hash := func(cost int) string {
+		h, err := bcrypt.GenerateFromPassword([]byte("secret"), cost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(h)
+	}
+	h5a, h5b, h6 := hash(5), hash(5), hash(6)
+
+	users, err := parseBasicUsers([]string{"alice:" + h5a, "bob:" + h5b})
+	if err != nil {
+		t.Fatalf("same-cost users refused: %v", err)
+	}
+	if cost, err := bcrypt.Cost(dummyHash(users)); err != nil || cost != 5 {
+		t.Errorf("dummy hash cost = %d, %v; want the users' 5", cost, err)
+	}
+	if _, err := parseBasicUsers([]string{"alice:" + h5a, "carol:" + h6}); err == nil {
+		t.Error("users hashed at different costs were accepted")
+	}
+	if _, err := parseBasicUsers([]string{"dave:2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"}); err == nil {
+		t.Error("a SHA-256 digest was accepted")
+	}
+}
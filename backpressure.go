@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// acquireTimeout is how long a request's probe may wait for a DNS/ICMP/TCP/UDP slot before the
+// request is shed (ACQUIRE_TIMEOUT); 0 waits for as long as the request lives
+var acquireTimeout time.Duration
+
+// shedKey carries the request's context.CancelCauseFunc, through which acquire sheds it
+type shedKey struct{}
+
+// overloadError is the cause a shed request's context is cancelled with
+type overloadError struct {
+	retryAfter time.Duration
+}
+
+func (e *overloadError) Error() string { return "probe capacity exhausted" }
+
+// retryAfter estimates when sem will have room: a caller that timed out waited acquireTimeout,
+// and each further capacity's worth of queued callers needs about as long again to drain
+func (s *semaphore) retryAfter() time.Duration {
+	depth := float64(s.waiting.Load()) / float64(cap(s.slots))
+	return time.Duration(float64(acquireTimeout) * (1 + depth))
+}
+
+// shed cancels the request behind ctx because sem stayed full, unless it is already done
+func shed(ctx context.Context, sem *semaphore) {
+	if cancel, ok := ctx.Value(shedKey{}).(context.CancelCauseFunc); ok {
+		cancel(&overloadError{retryAfter: sem.retryAfter()})
+	}
+}
+
+// overloaded returns the overloadError ctx was shed with, if any
+func overloaded(ctx context.Context) *overloadError {
+	var oe *overloadError
+	if errors.As(context.Cause(ctx), &oe) {
+		return oe
+	}
+	return nil
+}
+
+// backpressureMiddleware sheds a request whose probe waits longer than timeout for a semaphore
+// slot: its remaining probes are cancelled and, unless the response has already started, it
+// is answered with 503 and a Retry-After that grows with the queue depth, instead of with
+// results stretched by queueing. Returns nil when timeout is 0.
+func backpressureMiddleware(timeout time.Duration) gin.HandlerFunc {
+	if timeout <= 0 {
+		return nil
+	}
+	acquireTimeout = timeout
+	return func(c *gin.Context) {
+		req := c.Request
+		ctx, cancel := context.WithCancelCause(req.Context())
+		defer func() {
+			cancel(nil)
+			// Outer middleware (the request log) must see the client's context, not ours
+			c.Request = req
+		}()
+		c.Request = req.WithContext(context.WithValue(ctx, shedKey{}, cancel))
+		w := &shedWriter{ResponseWriter: c.Writer, c: c, ctx: ctx}
+		c.Writer = w
+		c.Next()
+		// Bodiless responses (304, c.Status) are only committed after the handlers return
+		w.check()
+	}
+}
+
+// shedWriter replaces the response of a shed request with a 503, as long as nothing was sent
+type shedWriter struct {
+	gin.ResponseWriter
+	c    *gin.Context
+	ctx  context.Context
+	shed bool
+}
+
+// check writes the 503 the first time the response is about to be committed after the request
+// was shed, and reports whether the handler's own output must be dropped
+func (w *shedWriter) check() bool {
+	if w.shed {
+		return true
+	}
+	if w.ResponseWriter.Written() {
+		return false
+	}
+	oe := overloaded(w.ctx)
+	if oe == nil {
+		return false
+	}
+	w.shed = true
+	h := w.Header()
+	for _, k := range []string{"Content-Length", "ETag", "Cache-Control", "X-Cache", "Idempotent-Replayed"} {
+		h.Del(k)
+	}
+	ct, body := errorBody(w.c, http.StatusServiceUnavailable, oe.Error())
+	h.Set("Content-Type", ct)
+	h.Set("Retry-After", strconv.Itoa(int(math.Ceil(max(oe.retryAfter, time.Second).Seconds()))))
+	w.ResponseWriter.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = w.ResponseWriter.Write(body)
+	return true
+}
+
+func (w *shedWriter) WriteHeader(code int) {
+	if !w.check() {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *shedWriter) WriteHeaderNow() {
+	if !w.check() {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *shedWriter) Write(p []byte) (int, error) {
+	if w.check() {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *shedWriter) WriteString(s string) (int, error) {
+	if w.check() {
+		return len(s), nil
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *shedWriter) Flush() {
+	if !w.check() {
+		w.ResponseWriter.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection for deadlines
+func (w *shedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBatchTargets caps the number of targets accepted by /api/ping/batch
+const maxBatchTargets = 256
+
+// batchRequest is the JSON body for /api/ping/batch
+type batchRequest struct {
+	Targets []string `json:"targets"`
+}
+
+// batchResult is one entry of the /api/ping/batch response
+type batchResult struct {
+	Input string `json:"input"`
+	pingResult
+}
+
+// failed reports whether the target ended with an error of its own, such as a failed lookup or
+// a probe that panicked
+func (r batchResult) failed() bool {
+	return r.Error != ""
+}
+
+// batchSummary counts the results of a batch and how many of them failed. It is the summary of
+// a JSON batch response, and the fields of the SSE "done" event and the NDJSON and CSV trailers.
+type batchSummary struct {
+	Count  int `json:"count"`
+	Errors int `json:"errors"`
+}
+
+// summarize returns the summary of results
+func summarize(results []batchResult) batchSummary {
+	s := batchSummary{Count: len(results)}
+	for _, r := range results {
+		if r.failed() {
+			s.Errors++
+		}
+	}
+	return s
+}
+
+// writeBatchJSON answers with the results of a batch and their summary, the error count also
+// in X-Batch-Errors
+func writeBatchJSON(c *gin.Context, results []batchResult) {
+	s := summarize(results)
+	c.Header("X-Batch-Errors", strconv.Itoa(s.Errors))
+	c.JSON(200, apiResponse{Code: 200, Msg: "success", Data: results, Summary: &s})
+}
+
+// bindBatch reads and validates a batch request body and its probe options, answering 400
+// itself when they are unusable
+func bindBatch(c *gin.Context) (batchRequest, probeOptions, bool) {
+	var req batchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, 400, "invalid request body")
+		return req, probeOptions{}, false
+	}
+	if len(req.Targets) == 0 {
+		abortWithError(c, 400, "no targets")
+		return req, probeOptions{}, false
+	}
+	if len(req.Targets) > maxBatchTargets {
+		abortWithError(c, 400, "too many targets")
+		return req, probeOptions{}, false
+	}
+	for i, t := range req.Targets {
+		t = strings.TrimSpace(t)
+		if !isValidInput(t) {
+			abortWithError(c, 400, "invalid ip or domain: "+t)
+			return req, probeOptions{}, false
+		}
+		req.Targets[i] = t
+	}
+
+	opts, err := parseProbeOptions(c)
+	for _, t := range req.Targets {
+		if err == nil {
+			err = opts.checkTarget(t)
+		}
+	}
+	if err != nil {
+		abortWithError(c, 400, err.Error())
+		return req, opts, false
+	}
+	return req, opts, true
+}
+
+// maxListTargets caps the comma-separated targets accepted by /api/ping/json?ip=a,b,c, which
+// unlike the batch endpoint needs no API key
+const maxListTargets = 16
+
+// handlePingList probes a comma-separated target list concurrently, answering with an array of
+// results in input order
+func handlePingList(c *gin.Context, list string) {
+	targets := strings.Split(list, ",")
+	if len(targets) > maxListTargets {
+		abortWithError(c, 400, fmt.Sprintf("too many targets (max %d)", maxListTargets))
+		return
+	}
+	for i, t := range targets {
+		t = strings.TrimSpace(t)
+		if !isValidInput(t) {
+			abortWithError(c, 400, "invalid ip or domain: "+t)
+			return
+		}
+		targets[i] = t
+	}
+	opts, err := parseProbeOptions(c)
+	for _, t := range targets {
+		if err == nil {
+			err = opts.checkTarget(t)
+		}
+	}
+	if err != nil {
+		abortWithError(c, 400, err.Error())
+		return
+	}
+	writeBatchJSON(c, probeAll(c.Request.Context(), targets, opts))
+}
+
+// probeAll probes every target concurrently on the probe pool and returns the results in
+// target order
+func probeAll(ctx context.Context, targets []string, opts probeOptions) []batchResult {
+	results := make([]batchResult, len(targets))
+	forEach(ctx, len(targets), func(i int) {
+		results[i] = batchResult{Input: targets[i], pingResult: safeResult(ctx, targets[i], opts)}
+	})
+	return results
+}
+
+// safeResult is cachedResult for one target of a batch. Batches run on probe pool workers,
+// where a panic would take the whole process down, so one while probing input is logged and
+// reported as that target's error while the other targets carry on.
+func safeResult(ctx context.Context, input string, opts probeOptions) (res pingResult) {
+	defer func() {
+		if v := recover(); v != nil {
+			slog.Error("probe panicked", "input", input, "panic", v, "stack", string(debug.Stack()))
+			res = pingResult{IPv4: StatusError, IPv6: StatusError, IPv4RTTms: -1, IPv6RTTms: -1,
+				Error: fmt.Sprintf("internal error: %v", v)}
+		}
+	}()
+	return cachedResult(ctx, input, opts)
+}
+
+// handleBatch probes every target concurrently through detectAndPing. A JSON batch sent with an
+// Idempotency-Key is answered once and replayed to retries of the same request.
+func handleBatch(c *gin.Context) {
+	req, opts, ok := bindBatch(c)
+	if !ok {
+		return
+	}
+
+	if wantsCSV(c) {
+		streamCSV(c, len(req.Targets), func(ctx context.Context, i int) batchResult {
+			return batchResult{Input: req.Targets[i], pingResult: safeResult(ctx, req.Targets[i], opts)}
+		})
+		return
+	}
+	if wantsPretty(c) {
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		c.Status(200)
+		writePretty(c.Writer, probeAll(c.Request.Context(), req.Targets, opts))
+		return
+	}
+	if wantsEventStream(c) {
+		streamEvents(c, len(req.Targets), func(ctx context.Context, i int) any {
+			return batchResult{Input: req.Targets[i], pingResult: safeResult(ctx, req.Targets[i], opts)}
+		})
+		return
+	}
+
+	key, ok := idempotencyKey(c)
+	if !ok {
+		return
+	}
+	if key == "" {
+		writeBatchJSON(c, probeAll(c.Request.Context(), req.Targets, opts))
+		return
+	}
+	results, replayed, err := idempotentProbeAll(c.Request.Context(), key, req.Targets, opts)
+	if errors.Is(err, errKeyReused) {
+		abortWithError(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		return // the client went away
+	}
+	if replayed {
+		c.Header("Idempotent-Replayed", "true")
+	}
+	writeBatchJSON(c, results)
+}
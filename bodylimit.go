@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bodyLimitMiddleware caps request bodies at limit bytes, answering 413 when exceeded. The body
+// is read up front (it is small by definition) so every route sees the same 413 instead of each
+// handler's own binding error.
+func bodyLimitMiddleware(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Body == nil || c.Request.Body == http.NoBody {
+			c.Next()
+			return
+		}
+		if c.Request.ContentLength > limit {
+			abortTooLarge(c, limit)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, limit))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			abortTooLarge(c, limit)
+			return
+		}
+		if err != nil {
+			abortWithError(c, 400, "failed to read request body")
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Next()
+	}
+}
+
+func abortTooLarge(c *gin.Context, limit int64) {
+	c.Header("Connection", "close")
+	abortWithError(c, 413, "request body too large (max "+strconv.FormatInt(limit, 10)+" bytes)")
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ttlCache is a size-bounded LRU whose entries also expire after a per-entry TTL
+type ttlCache[V any] struct {
+	max int
+
+	mu    sync.Mutex
+	ll    *list.List // front = most recently used
+	items map[string]*list.Element
+}
+
+type cacheEntry[V any] struct {
+	key     string
+	val     V
+	expires time.Time
+}
+
+func newTTLCache[V any](max int) *ttlCache[V] {
+	return &ttlCache[V]{max: max, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+// get returns a live entry and its expiry time
+func (c *ttlCache[V]) get(key string) (V, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var zero V
+	e, ok := c.items[key]
+	if !ok {
+		return zero, time.Time{}, false
+	}
+	ent := e.Value.(*cacheEntry[V])
+	if time.Now().After(ent.expires) {
+		c.ll.Remove(e)
+		delete(c.items, key)
+		return zero, time.Time{}, false
+	}
+	c.ll.MoveToFront(e)
+	return ent.val, ent.expires, true
+}
+
+// set stores val for ttl, evicting the least recently used entries beyond max
+func (c *ttlCache[V]) set(key string, val V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := time.Now().Add(ttl)
+	if e, ok := c.items[key]; ok {
+		ent := e.Value.(*cacheEntry[V])
+		ent.val, ent.expires = val, expires
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&cacheEntry[V]{key: key, val: val, expires: expires})
+	for c.ll.Len() > c.max {
+		old := c.ll.Back()
+		c.ll.Remove(old)
+		delete(c.items, old.Value.(*cacheEntry[V]).key)
+	}
+}
+
+// resultCache holds results for CACHE_TTL when reachable, CACHE_NEG_TTL (shorter) when not;
+// sized by setupSemaphores
+var resultCache *ttlCache[pingResult]
+
+// cacheKey identifies a probe by its input and every option that shapes the result
+func (o probeOptions) cacheKey(input string) string {
+	return strings.Join([]string{
+		strings.ToLower(input),
+		strings.Join(o.Ports, ","),
+		strings.Join(o.UDPPorts, ","),
+		strconv.Itoa(o.Count),
+		strconv.FormatBool(o.PTR),
+		strconv.FormatBool(o.TLS),
+		strconv.FormatBool(o.CNAME),
+		strconv.FormatBool(o.NoSysPing),
+		o.Family,
+		o.DNS,
+		strings.Join(o.Methods, ","),
+		o.Src.String(),
+		o.Timeout.String(),
+		o.TCPTimeout.String(),
+		hex.EncodeToString(o.Payload),
+		strconv.Itoa(o.MaxTTL),
+	}, "|")
+}
+
+// cachedResult is cachedDetectAndPing without the cache status, for multi-target endpoints
+func cachedResult(ctx context.Context, input string, opts probeOptions) pingResult {
+	res, _ := cachedDetectAndPing(ctx, input, opts)
+	return res
+}
+
+// cacheStatus says how a result relates to the result cache
+type cacheStatus struct {
+	hit     bool      // served from the cache
+	expires time.Time // when the cached copy expires; zero when the result isn't cached
+}
+
+// setCacheHeaders reports X-Cache: HIT/MISS when the result cache is enabled. A cached result
+// also gets Cache-Control: max-age for its remaining TTL and an ETag over variant (the
+// representation), input and result; a matching If-None-Match is answered with 304, in which
+// case it returns true and the caller must not write a body.
+func setCacheHeaders(c *gin.Context, cs cacheStatus, variant, input string, res pingResult) bool {
+	if cfg.CacheTTL <= 0 {
+		return false
+	}
+	if cs.hit {
+		c.Header("X-Cache", "HIT")
+	} else {
+		c.Header("X-Cache", "MISS")
+	}
+	remaining := time.Until(cs.expires)
+	if cs.expires.IsZero() || remaining <= 0 {
+		c.Header("Cache-Control", "no-store")
+		return false
+	}
+	c.Header("Cache-Control", "max-age="+strconv.Itoa(int(remaining.Seconds())))
+	body, _ := json.Marshal(res)
+	sum := sha256.Sum256([]byte(variant + "\x00" + input + "\x00" + string(body)))
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Header("ETag", etag)
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// etagMatches applies If-None-Match's weak comparison: any listed tag, or "*", matches
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedDetectAndPing serves from the result cache when enabled, reporting a hit and when the
+// cached copy expires
+func cachedDetectAndPing(ctx context.Context, input string, opts probeOptions) (pingResult, cacheStatus) {
+	if cfg.CacheTTL <= 0 {
+		return detectAndPing(ctx, input, opts), cacheStatus{}
+	}
+	key := opts.cacheKey(input)
+	if res, expires, ok := resultCache.get(key); ok {
+		return res, cacheStatus{hit: true, expires: expires}
+	}
+	res := detectAndPing(ctx, input, opts)
+	// Results cut short by a disconnected client or the deadline say nothing about the target
+	if ctx.Err() != nil || res.TimedOut {
+		return res, cacheStatus{}
+	}
+	ttl := time.Duration(cfg.CacheTTL)
+	if !res.reachable() {
+		ttl = time.Duration(cfg.CacheNegTTL)
+	}
+	if ttl <= 0 {
+		return res, cacheStatus{}
+	}
+	resultCache.set(key, res, ttl)
+	return res, cacheStatus{expires: time.Now().Add(ttl)}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// certReloader serves the TLS_CERT/TLS_KEY pair and re-reads it on SIGHUP, so certificates
+// can be rotated without a restart
+type certReloader struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+// newCertReloader loads the pair once; a bad pair at startup is an error, not a warning
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert.Store(&cert)
+	return nil
+}
+
+// getCertificate is the tls.Config callback: every handshake sees the latest loaded pair
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// watch reloads the pair on every SIGHUP until ctx ends. A failed reload (say, a half-written
+// file) keeps serving the previous certificate.
+func (r *certReloader) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+			if err := r.load(); err != nil {
+				slog.Warn("tls certificate reload failed, keeping the current one", "cert", r.certFile, "err", err)
+				continue
+			}
+			slog.Info("tls certificate reloaded", "cert", r.certFile)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,339 @@
+// Package client is a Go client for the ipcheck HTTP API.
+//
+//	c := client.New("http://localhost:5601")
+//	res, err := c.Ping(ctx, "example.com")
+//
+// Results mirror the JSON the server sends; see the README for the meaning of each field.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status is a family's probe outcome
+type Status string
+
+const (
+	StatusReachable     Status = "reachable"
+	StatusUnreachable   Status = "unreachable"
+	StatusTimeout       Status = "timeout"
+	StatusDNSError      Status = "dns_error"
+	StatusNotApplicable Status = "not_applicable"
+	StatusError         Status = "error"
+)
+
+// Result is the outcome of probing one target (the data of /api/ping/json)
+type Result struct {
+	IPv4      Status   `json:"ipv4"`
+	IPv6      Status   `json:"ipv6"`
+	IPv4Addrs []string `json:"ipv4_addrs,omitempty"`
+	IPv6Addrs []string `json:"ipv6_addrs,omitempty"`
+	IPv4RTTms float64  `json:"ipv4_rtt_ms"` // -1 when no echo reply
+	IPv6RTTms float64  `json:"ipv6_rtt_ms"`
+	Resolved  bool     `json:"resolved"`
+	Error     string   `json:"error,omitempty"`
+	TimedOut  bool     `json:"timedout,omitempty"`
+
+	IPv4Resolved int `json:"ipv4_resolved,omitempty"`
+	IPv6Resolved int `json:"ipv6_resolved,omitempty"`
+	IPv4Probed   int `json:"ipv4_probed,omitempty"`
+	IPv6Probed   int `json:"ipv6_probed,omitempty"`
+
+	IPv4PTR map[string][]string `json:"ipv4_ptr,omitempty"`
+	IPv6PTR map[string][]string `json:"ipv6_ptr,omitempty"`
+
+	IPv4Geo map[string]Geo `json:"ipv4_geo,omitempty"`
+	IPv6Geo map[string]Geo `json:"ipv6_geo,omitempty"`
+
+	IPv4Loss *float64 `json:"ipv4_loss,omitempty"`
+	IPv6Loss *float64 `json:"ipv6_loss,omitempty"`
+
+	Stats *struct {
+		IPv4 *RTTStats `json:"ipv4,omitempty"`
+		IPv6 *RTTStats `json:"ipv6,omitempty"`
+	} `json:"stats,omitempty"`
+
+	IPv4TTL int    `json:"ipv4_ttl,omitempty"`
+	IPv6TTL int    `json:"ipv6_ttl,omitempty"`
+	TTLNote string `json:"ttl_note,omitempty"`
+
+	IPv4Attempts int `json:"ipv4_attempts,omitempty"`
+	IPv6Attempts int `json:"ipv6_attempts,omitempty"`
+
+	IPv4Method string `json:"ipv4_method,omitempty"` // "icmp", "tcp:<port>", "udp:<port>" or "system-ping"
+	IPv6Method string `json:"ipv6_method,omitempty"`
+
+	IPv4ReplyType string `json:"ipv4_reply_type,omitempty"` // non-echo ICMP reply accepted as alive (server ICMP_ALIVE_TYPES)
+	IPv6ReplyType string `json:"ipv6_reply_type,omitempty"`
+
+	IPv4WithinMaxTTL *bool `json:"ipv4_within_maxttl,omitempty"` // with maxttl: echo reply (true) or time exceeded (false)
+	IPv6WithinMaxTTL *bool `json:"ipv6_within_maxttl,omitempty"`
+
+	SpoofedSource bool `json:"spoofed_source,omitempty"`
+
+	PayloadIntact *bool `json:"payload_intact,omitempty"` // with a pattern option: replies echoed it unchanged
+
+	NoLocalIPv6 bool `json:"no_local_ipv6,omitempty"` // the server has no IPv6, so IPv6 was not probed
+
+	ICMPError *struct {
+		IPv4 *ICMPError `json:"ipv4,omitempty"`
+		IPv6 *ICMPError `json:"ipv6,omitempty"`
+	} `json:"icmp_error,omitempty"`
+
+	TLS *struct {
+		IPv4 *TLSInfo `json:"ipv4,omitempty"`
+		IPv6 *TLSInfo `json:"ipv6,omitempty"`
+	} `json:"tls,omitempty"`
+
+	CNAMEChain    []string `json:"cname_chain,omitempty"`
+	DanglingCNAME bool     `json:"dangling_cname,omitempty"`
+
+	Timings *Timings `json:"timings,omitempty"`
+}
+
+// Reachable reports whether either family was reachable
+func (r *Result) Reachable() bool {
+	return r.IPv4 == StatusReachable || r.IPv6 == StatusReachable
+}
+
+// BatchResult is one entry of a batch response, in the order the targets were given
+type BatchResult struct {
+	Input string `json:"input"`
+	Result
+}
+
+// Geo is the country/ASN of an address (servers with GEOIP_DB)
+type Geo struct {
+	Country string `json:"country,omitempty"`
+	ASN     uint   `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+// RTTStats summarises the echoes of one family (count>1)
+type RTTStats struct {
+	MinMs    float64 `json:"min_ms"`
+	AvgMs    float64 `json:"avg_ms"`
+	MaxMs    float64 `json:"max_ms"`
+	JitterMs float64 `json:"jitter_ms"`
+}
+
+// ICMPError is an unreachable/time exceeded message received instead of echo replies
+type ICMPError struct {
+	Type   string `json:"type"`
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+	From   string `json:"from"`
+}
+
+// TLSInfo describes the certificate served on port 443 (tls=1)
+type TLSInfo struct {
+	Address        string   `json:"address,omitempty"`
+	Version        string   `json:"version,omitempty"`
+	Subject        string   `json:"subject,omitempty"`
+	Issuer         string   `json:"issuer,omitempty"`
+	SANs           []string `json:"sans,omitempty"`
+	NotAfter       string   `json:"not_after,omitempty"`
+	Expired        bool     `json:"expired,omitempty"`
+	ConnectError   string   `json:"connect_error,omitempty"`
+	HandshakeError string   `json:"handshake_error,omitempty"`
+}
+
+// Timings breaks a probe's latency down by phase; phases that never ran are nil
+type Timings struct {
+	DNSms   *float64 `json:"dns_ms,omitempty"`
+	ICMPms  *float64 `json:"icmp_ms,omitempty"`
+	TCPms   *float64 `json:"tcp_ms,omitempty"`
+	UDPms   *float64 `json:"udp_ms,omitempty"`
+	PingMs  *float64 `json:"ping_ms,omitempty"`
+	TotalMs float64  `json:"total_ms"`
+}
+
+// Errors an *APIError matches with errors.Is, by HTTP status
+var (
+	ErrBadRequest   = errors.New("bad request")            // 400: invalid target or option
+	ErrUnauthorized = errors.New("unauthorized")           // 401: missing or wrong API key
+	ErrTooLarge     = errors.New("request too large")      // 413: body above MAX_BODY_BYTES
+	ErrKeyReused    = errors.New("idempotency key reused") // 422: the key was sent with a different batch
+	ErrRateLimited  = errors.New("rate limited")           // 429: RATE_LIMIT_RPS exceeded
+	ErrUnavailable  = errors.New("service unavailable")    // 503: MAX_INFLIGHT_REQUESTS reached or ACQUIRE_TIMEOUT exceeded
+	ErrServer       = errors.New("server error")           // any other 5xx
+)
+
+// APIError is a response the server refused or failed to answer with a result
+type APIError struct {
+	StatusCode int           // HTTP status
+	Message    string        // the server's msg, or the body when it sent no JSON envelope
+	RetryAfter time.Duration // from Retry-After on 429/503, zero when absent
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("ipcheck: %d %s", e.StatusCode, e.Message)
+}
+
+// Is maps the status to one of the Err* sentinels
+func (e *APIError) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusBadRequest:
+		return target == ErrBadRequest
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusRequestEntityTooLarge:
+		return target == ErrTooLarge
+	case http.StatusUnprocessableEntity:
+		return target == ErrKeyReused
+	case http.StatusTooManyRequests:
+		return target == ErrRateLimited
+	case http.StatusServiceUnavailable:
+		return target == ErrUnavailable
+	}
+	return e.StatusCode >= 500 && target == ErrServer
+}
+
+// Client calls one ipcheck server. Its fields may be set after New and before first use.
+type Client struct {
+	BaseURL    string       // e.g. "http://localhost:5601", without the /api suffix
+	HTTPClient *http.Client // http.DefaultClient when nil
+	APIKey     string       // sent as a bearer token when set (API_KEYS)
+	Username   string       // with Password, sent as Basic credentials when APIKey is empty (BASIC_AUTH_USERS)
+	Password   string
+	Params     url.Values // probe options added to every request, e.g. timeout, family, count
+}
+
+// New returns a Client for the server at baseURL
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Ping probes a single IP or domain through GET /api/ping/json. A probe the server timed out
+// on is a result (TimedOut set, HTTP 504), not an error.
+func (c *Client) Ping(ctx context.Context, input string) (*Result, error) {
+	// The endpoint answers a comma-separated list with an array; that is PingBatch's job
+	if input == "" || strings.Contains(input, ",") {
+		return nil, fmt.Errorf("ipcheck: invalid target %q", input)
+	}
+	q := url.Values{"ip": {input}}
+	req, err := c.newRequest(ctx, http.MethodGet, "/api/ping/json", q, nil)
+	if err != nil {
+		return nil, err
+	}
+	var res Result
+	if err := c.do(req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// PingBatch probes up to 256 targets through POST /api/ping/batch, which needs an API key when
+// the server sets API_KEYS. Results come back in target order.
+func (c *Client) PingBatch(ctx context.Context, targets []string) ([]BatchResult, error) {
+	return c.PingBatchIdempotent(ctx, "", targets)
+}
+
+// PingBatchIdempotent is PingBatch sending key as the Idempotency-Key: retrying with the same
+// key and targets within the server's IDEMPOTENCY_TTL returns the first run's results instead
+// of probing again. An empty key sends none.
+func (c *Client) PingBatchIdempotent(ctx context.Context, key string, targets []string) ([]BatchResult, error) {
+	body, err := json.Marshal(struct {
+		Targets []string `json:"targets"`
+	}{targets})
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/api/ping/batch", nil, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	var res []BatchResult
+	if err := c.do(req, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// newRequest builds a request for path with c.Params merged under q
+func (c *Client) newRequest(ctx context.Context, method, path string, q url.Values, body []byte) (*http.Request, error) {
+	params := url.Values{}
+	for k, v := range c.Params {
+		params[k] = v
+	}
+	for k, v := range q {
+		params[k] = v
+	}
+	u := c.BaseURL + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	} else if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	return req, nil
+}
+
+// envelope is the server's {code, msg, data} response wrapper
+type envelope struct {
+	Code int             `json:"code"`
+	Msg  string          `json:"msg"`
+	Data json.RawMessage `json:"data"`
+}
+
+// do sends req and decodes the envelope's data into out, turning refusals into *APIError
+func (c *Client) do(req *http.Request, out any) error {
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var env envelope
+	jsonErr := json.Unmarshal(raw, &env)
+	// A timed-out probe is still answered with its (partial) result
+	if resp.StatusCode != http.StatusOK && (resp.StatusCode != http.StatusGatewayTimeout || jsonErr != nil || len(env.Data) == 0) {
+		apiErr := &APIError{StatusCode: resp.StatusCode, Message: env.Msg}
+		if apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(raw))
+		}
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			apiErr.RetryAfter = time.Duration(s) * time.Second
+		}
+		return apiErr
+	}
+	if jsonErr != nil {
+		return fmt.Errorf("ipcheck: decoding response: %w", jsonErr)
+	}
+	if err := json.Unmarshal(env.Data, out); err != nil {
+		return fmt.Errorf("ipcheck: decoding response: %w", err)
+	}
+	return nil
+}
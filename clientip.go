@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// checkTrustedProxies accepts IP addresses and CIDR prefixes, the forms SetTrustedProxies takes
+func checkTrustedProxies(list []string) error {
+	for _, s := range list {
+		if _, err := netip.ParsePrefix(s); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(s); err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: want an IP or CIDR", s)
+		}
+	}
+	return nil
+}
+
+// clientIP is the effective client address: the X-Forwarded-For / X-Real-IP hop nearest a
+// trusted proxy when the connection came through one, the peer address otherwise. IPv4-mapped
+// IPv6 addresses are unmapped and zones dropped, so one client always yields one key.
+func clientIP(c *gin.Context) string {
+	ip := c.ClientIP()
+	a, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return ip
+	}
+	return a.Unmap().WithZone("").String()
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	configFlag = flag.String("config", "", "path to a JSON config file (env vars and flags override it)")
+	listenFlag = flag.String("listen", "", `bind address, "host:port" or "unix:/path/to.sock" (overrides LISTEN_ADDR)`)
+	certFlag   = flag.String("tls-cert", "", "PEM certificate (chain) to serve HTTPS with (overrides TLS_CERT)")
+	keyFlag    = flag.String("tls-key", "", "PEM private key for -tls-cert (overrides TLS_KEY)")
+)
+
+// maxICMPRetries bounds ICMP_RETRIES so backoff shares stay meaningful
+const maxICMPRetries = 5
+
+// cfg is the effective configuration, loaded once in main before anything serves
+var cfg Config
+
+// Config holds the startup settings. Values are layered file < env < flags; zero values
+// mean "use the built-in default", so an empty file behaves exactly like no file.
+type Config struct {
+	ListenAddr string `json:"listen_addr"`
+
+	MaxDNS  int `json:"max_dns"`
+	MaxICMP int `json:"max_icmp"`
+	MaxTCP  int `json:"max_tcp"`
+	MaxUDP  int `json:"max_udp"`
+
+	MaxWorkers int `json:"max_workers"` // goroutines running per-target probes across all batches and scans
+
+	MaxInflightRequests int      `json:"max_inflight_requests"` // concurrent probe requests, 0 = unlimited
+	InflightQueueWait   duration `json:"inflight_queue_wait"`   // how long an excess request may wait for a slot before 503
+	AcquireTimeout      duration `json:"acquire_timeout"`       // how long a probe may wait for a semaphore slot before its request is shed with 503, 0 = no limit
+
+	ProbeTimeout  duration `json:"probe_timeout"`  // default for ?timeout=
+	ShutdownGrace duration `json:"shutdown_grace"` // drain time on SIGINT/SIGTERM
+
+	TCPDialTimeout duration `json:"tcp_dial_timeout"` // per-connect timeout of the TCP race, 0 scales it with the race window
+
+	Ports    []string `json:"ports"`     // TCP fallback ports
+	UDPPorts []string `json:"udp_ports"` // UDP fallback ports
+
+	RateLimitRPS        float64 `json:"rate_limit_rps"` // 0 disables rate limiting
+	RateLimitBurst      int     `json:"rate_limit_burst"`
+	RateLimitMaxClients int     `json:"rate_limit_max_clients"`
+
+	APIKeys     []string `json:"api_keys"`      // bearer tokens for batch/scan; empty disables auth
+	APIAuthPing bool     `json:"api_auth_ping"` // also require a key on /api/ping and /api/ping/json
+
+	BasicAuthUsers []string `json:"basic_auth_users"` // "user:bcrypt-hash" accepted besides API keys
+
+	SourceIPv4 string `json:"source_ipv4"` // local address probes originate from; empty = OS choice
+	SourceIPv6 string `json:"source_ipv6"`
+
+	ICMPRetries int  `json:"icmp_retries"` // resends per echo before counting it lost
+	ICMPID      *int `json:"icmp_id"`      // base echo identifier, 0-65535; unset means the PID
+
+	CORSOrigins []string `json:"cors_origins"` // origins allowed to call /api cross-origin, "*" for any
+
+	TrustedProxies []string `json:"trusted_proxies"` // IPs/CIDRs whose X-Forwarded-For is believed; empty trusts none
+
+	SOCKS5Proxy string `json:"socks5_proxy"` // route TCP probes through this proxy and skip ICMP/UDP/ping
+
+	DisableSystemPing bool   `json:"disable_system_ping"` // never shell out to ping
+	PingBin           string `json:"ping_bin"`            // ping binary name or path, resolved once at startup
+
+	MaxBodyBytes int64 `json:"max_body_bytes"` // request body cap, 413 beyond it
+
+	EnableH2C bool `json:"enable_h2c"` // also accept plaintext HTTP/2 with prior knowledge
+
+	DNSSplitQueries bool `json:"dns_split_queries"` // resolve A and AAAA with separate queries, never one "ip" lookup
+
+	ForceIPv6 bool `json:"force_ipv6"` // probe IPv6 even when no interface has a global IPv6 address
+
+	ProbeVRF string `json:"probe_vrf"` // bind probe sockets to this VRF (or other) device, Linux only
+
+	TLSCert string `json:"tls_cert"` // serve HTTPS with this PEM certificate; empty serves plaintext
+	TLSKey  string `json:"tls_key"`
+
+	ProbeOrder []string `json:"probe_order"` // probe methods in the order they are tried
+
+	ICMPAliveTypes []string `json:"icmp_alive_types"` // non-echo ICMP replies that also prove a host alive, see aliveReplyTypes
+
+	MaxProbeIPs int `json:"max_probe_ips"` // resolved addresses probed per family, the first N win
+
+	CacheTTL        duration `json:"cache_ttl"`         // how long reachable results are cached, 0 disables the cache
+	CacheNegTTL     duration `json:"cache_neg_ttl"`     // the same for unreachable results; 0 means a quarter of cache_ttl
+	CacheMaxEntries int      `json:"cache_max_entries"` // cached results kept, least recently used evicted first
+
+	IdempotencyTTL     duration `json:"idempotency_ttl"`      // how long a batch is replayed to retries of its Idempotency-Key
+	IdempotencyMaxKeys int      `json:"idempotency_max_keys"` // idempotency keys kept, least recently used evicted first
+
+	MaxMonitors int `json:"max_monitors"` // open /ws/monitor sockets across all clients
+
+	ScanMaxHosts     int `json:"scan_max_hosts"`     // addresses one /api/scan may expand to
+	PortscanMaxPorts int `json:"portscan_max_ports"` // ports one /api/portscan may cover
+
+	DoHEndpoint string `json:"doh_endpoint"` // resolve through this DNS-over-HTTPS URL; exclusive with dns_server
+	DNSServer   string `json:"dns_server"`   // resolve through this server, "[udp://|tcp://]ip[:port]"
+	HostsFile   string `json:"hosts_file"`   // names pinned to fixed addresses, see loadHostsFile
+	GeoIPDB     string `json:"geoip_db"`     // MaxMind database for country/ASN enrichment; empty disables it
+
+	EnablePprof bool   `json:"enable_pprof"` // serve /debug/pprof/ on PprofAddr
+	PprofAddr   string `json:"pprof_addr"`   // loopback host:port for pprof
+
+	CSPPolicy    string `json:"csp_policy"`    // Content-Security-Policy value, "off" to omit it
+	FrameOptions string `json:"frame_options"` // X-Frame-Options value, "off" to omit it
+	ServeIndex   *bool  `json:"serve_index"`   // serve index.html at /; unset means true
+
+	DisableGzip  bool `json:"disable_gzip"`   // never compress responses
+	GzipMinBytes int  `json:"gzip_min_bytes"` // smallest response body worth compressing
+
+	StrictConfig bool `json:"strict_config"` // refuse to start when an env var holds an unusable value
+
+	AccessLog     string `json:"access_log"`      // "combined" writes Combined Log Format lines; empty disables
+	AccessLogFile string `json:"access_log_file"` // where access log lines go; empty means stdout
+}
+
+// duration is a time.Duration written as a Go duration string ("5s") in JSON
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New(`durations must be strings such as "5s"`)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadConfig reads the optional file at path, then applies env vars, flags and defaults
+func loadConfig(path string) (Config, error) {
+	var c Config
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return c, err
+		}
+		defer f.Close()
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&c); err != nil {
+			return c, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	c.setDefaults()
+	if err := c.applyEnv(); err != nil {
+		return c, err
+	}
+	if *listenFlag != "" {
+		c.ListenAddr = *listenFlag
+	}
+	if *certFlag != "" {
+		c.TLSCert = *certFlag
+	}
+	if *keyFlag != "" {
+		c.TLSKey = *keyFlag
+	}
+	return c, c.validate()
+}
+
+// setDefaults fills zero fields with the built-in defaults
+func (c *Config) setDefaults() {
+	if c.ListenAddr == "" {
+		c.ListenAddr = defaultListenAddr
+	}
+	c.MaxDNS = cmp.Or(c.MaxDNS, 4096)
+	c.MaxICMP = cmp.Or(c.MaxICMP, 8192)
+	c.MaxTCP = cmp.Or(c.MaxTCP, 8192)
+	c.MaxUDP = cmp.Or(c.MaxUDP, 4096)
+	c.MaxWorkers = cmp.Or(c.MaxWorkers, 1024)
+	c.GzipMinBytes = cmp.Or(c.GzipMinBytes, defaultGzipMinBytes)
+	c.ProbeTimeout = cmp.Or(c.ProbeTimeout, duration(defaultProbeTimeout))
+	c.ShutdownGrace = cmp.Or(c.ShutdownGrace, duration(10*time.Second))
+	if len(c.Ports) == 0 {
+		c.Ports = defaultPorts
+	}
+	if len(c.UDPPorts) == 0 {
+		c.UDPPorts = defaultUDPPorts
+	}
+	c.RateLimitMaxClients = cmp.Or(c.RateLimitMaxClients, 10000)
+	c.PingBin = cmp.Or(c.PingBin, "ping")
+	c.MaxBodyBytes = cmp.Or(c.MaxBodyBytes, 1<<20)
+	c.MaxProbeIPs = cmp.Or(c.MaxProbeIPs, 4)
+	c.CacheMaxEntries = cmp.Or(c.CacheMaxEntries, 10000)
+	c.IdempotencyTTL = cmp.Or(c.IdempotencyTTL, duration(10*time.Minute))
+	c.IdempotencyMaxKeys = cmp.Or(c.IdempotencyMaxKeys, 1000)
+	c.MaxMonitors = cmp.Or(c.MaxMonitors, 256)
+	c.ScanMaxHosts = cmp.Or(c.ScanMaxHosts, 1024)
+	c.PortscanMaxPorts = cmp.Or(c.PortscanMaxPorts, 1024)
+	c.PprofAddr = cmp.Or(c.PprofAddr, defaultPprofAddr)
+	c.CSPPolicy = cmp.Or(c.CSPPolicy, defaultCSP)
+	c.FrameOptions = cmp.Or(c.FrameOptions, "DENY")
+	if c.ServeIndex == nil {
+		serve := true
+		c.ServeIndex = &serve
+	}
+	if len(c.ProbeOrder) == 0 {
+		c.ProbeOrder = defaultProbeOrder
+	}
+	if c.ICMPID == nil {
+		id := os.Getpid() & 0xffff
+		c.ICMPID = &id
+	}
+}
+
+// applyEnv overrides file values with any env vars that are set
+func (c *Config) applyEnv() error {
+	if v := strings.TrimSpace(os.Getenv("LISTEN_ADDR")); v != "" {
+		c.ListenAddr = v
+	}
+	c.MaxDNS = getEnvInt("MAX_DNS", c.MaxDNS)
+	c.MaxICMP = getEnvInt("MAX_ICMP", c.MaxICMP)
+	c.MaxTCP = getEnvInt("MAX_TCP", c.MaxTCP)
+	c.MaxUDP = getEnvInt("MAX_UDP", c.MaxUDP)
+	c.MaxWorkers = getEnvInt("MAX_WORKERS", c.MaxWorkers)
+	c.MaxInflightRequests = getEnvIntZero("MAX_INFLIGHT_REQUESTS", c.MaxInflightRequests)
+	c.GzipMinBytes = getEnvInt("GZIP_MIN_BYTES", c.GzipMinBytes)
+	c.InflightQueueWait = duration(getEnvDurationZero("INFLIGHT_QUEUE_WAIT", time.Duration(c.InflightQueueWait)))
+	c.AcquireTimeout = duration(getEnvDurationZero("ACQUIRE_TIMEOUT", time.Duration(c.AcquireTimeout)))
+	c.ShutdownGrace = duration(getEnvDuration("SHUTDOWN_GRACE", time.Duration(c.ShutdownGrace)))
+	c.TCPDialTimeout = duration(getEnvDurationZero("TCP_DIAL_TIMEOUT", time.Duration(c.TCPDialTimeout)))
+	if spec := strings.TrimSpace(os.Getenv("UDP_PORTS")); spec != "" {
+		ports, err := parsePorts(spec)
+		if err != nil {
+			return fmt.Errorf("invalid UDP_PORTS: %w", err)
+		}
+		c.UDPPorts = ports
+	}
+	c.RateLimitRPS = getEnvFloatZero("RATE_LIMIT_RPS", c.RateLimitRPS)
+	c.RateLimitBurst = getEnvIntZero("RATE_LIMIT_BURST", c.RateLimitBurst)
+	c.RateLimitMaxClients = getEnvInt("RATE_LIMIT_MAX_CLIENTS", c.RateLimitMaxClients)
+	c.MaxBodyBytes = int64(getEnvInt("MAX_BODY_BYTES", int(c.MaxBodyBytes)))
+	c.MaxProbeIPs = getEnvInt("MAX_PROBE_IPS", c.MaxProbeIPs)
+	c.CacheTTL = duration(getEnvDurationZero("CACHE_TTL", time.Duration(c.CacheTTL)))
+	c.CacheNegTTL = duration(getEnvDurationZero("CACHE_NEG_TTL", time.Duration(c.CacheNegTTL)))
+	c.CacheMaxEntries = getEnvInt("CACHE_MAX_ENTRIES", c.CacheMaxEntries)
+	c.IdempotencyTTL = duration(getEnvDuration("IDEMPOTENCY_TTL", time.Duration(c.IdempotencyTTL)))
+	c.IdempotencyMaxKeys = getEnvInt("IDEMPOTENCY_MAX_KEYS", c.IdempotencyMaxKeys)
+	c.MaxMonitors = getEnvInt("MAX_MONITORS", c.MaxMonitors)
+	c.ScanMaxHosts = getEnvInt("SCAN_MAX_HOSTS", c.ScanMaxHosts)
+	c.PortscanMaxPorts = getEnvInt("PORTSCAN_MAX_PORTS", c.PortscanMaxPorts)
+	if v := strings.TrimSpace(os.Getenv("DOH_ENDPOINT")); v != "" {
+		c.DoHEndpoint = v
+	}
+	if v := strings.TrimSpace(os.Getenv("DNS_SERVER")); v != "" {
+		c.DNSServer = v
+	}
+	if v := strings.TrimSpace(os.Getenv("HOSTS_FILE")); v != "" {
+		c.HostsFile = v
+	}
+	if v := strings.TrimSpace(os.Getenv("GEOIP_DB")); v != "" {
+		c.GeoIPDB = v
+	}
+	if origins := getEnvList("CORS_ORIGINS"); len(origins) > 0 {
+		c.CORSOrigins = origins
+	}
+	if proxies := getEnvList("TRUSTED_PROXIES"); len(proxies) > 0 {
+		c.TrustedProxies = proxies
+	}
+	if keys := getEnvList("API_KEYS"); len(keys) > 0 {
+		c.APIKeys = keys
+	}
+	if users := getEnvList("BASIC_AUTH_USERS"); len(users) > 0 {
+		c.BasicAuthUsers = users
+	}
+	if order := getEnvList("PROBE_ORDER"); len(order) > 0 {
+		c.ProbeOrder = order
+	}
+	if types := getEnvList("ICMP_ALIVE_TYPES"); len(types) > 0 {
+		c.ICMPAliveTypes = types
+	}
+	// 0 is meaningful for both, so these can't use getEnvInt
+	if v := strings.TrimSpace(os.Getenv("ICMP_RETRIES")); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.ICMPRetries = n
+		} else {
+			badEnv("ICMP_RETRIES", v, fmt.Sprintf("an integer 0-%d", maxICMPRetries))
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("ICMP_ID")); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.ICMPID = &n
+		} else {
+			badEnv("ICMP_ID", v, "an integer 0-65535")
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("SOURCE_IPV4")); v != "" {
+		c.SourceIPv4 = v
+	}
+	if v := strings.TrimSpace(os.Getenv("SOURCE_IPV6")); v != "" {
+		c.SourceIPv6 = v
+	}
+	if v := strings.TrimSpace(os.Getenv("PROBE_VRF")); v != "" {
+		c.ProbeVRF = v
+	}
+	if v := strings.TrimSpace(os.Getenv("SOCKS5_PROXY")); v != "" {
+		c.SOCKS5Proxy = v
+	}
+	if v := strings.TrimSpace(os.Getenv("PING_BIN")); v != "" {
+		c.PingBin = v
+	}
+	c.DisableSystemPing = getEnvBool("DISABLE_SYSTEM_PING", c.DisableSystemPing)
+	c.APIAuthPing = getEnvBool("API_AUTH_PING", c.APIAuthPing)
+	if v := strings.TrimSpace(os.Getenv("TLS_CERT")); v != "" {
+		c.TLSCert = v
+	}
+	if v := strings.TrimSpace(os.Getenv("TLS_KEY")); v != "" {
+		c.TLSKey = v
+	}
+	c.EnableH2C = getEnvBool("ENABLE_H2C", c.EnableH2C)
+	if v := strings.TrimSpace(os.Getenv("ACCESS_LOG")); v != "" {
+		c.AccessLog = strings.ToLower(v)
+	}
+	if v := strings.TrimSpace(os.Getenv("ACCESS_LOG_FILE")); v != "" {
+		c.AccessLogFile = v
+	}
+	c.DisableGzip = getEnvBool("DISABLE_GZIP", c.DisableGzip)
+	c.ForceIPv6 = getEnvBool("FORCE_IPV6", c.ForceIPv6)
+	c.DNSSplitQueries = getEnvBool("DNS_SPLIT_QUERIES", c.DNSSplitQueries)
+	c.EnablePprof = getEnvBool("ENABLE_PPROF", c.EnablePprof)
+	if v := strings.TrimSpace(os.Getenv("PPROF_ADDR")); v != "" {
+		c.PprofAddr = v
+	}
+	if v := strings.TrimSpace(os.Getenv("CSP_POLICY")); v != "" {
+		c.CSPPolicy = v
+	}
+	if v := strings.TrimSpace(os.Getenv("FRAME_OPTIONS")); v != "" {
+		c.FrameOptions = v
+	}
+	if os.Getenv("SERVE_INDEX") != "" {
+		serve := getEnvBool("SERVE_INDEX", true)
+		c.ServeIndex = &serve
+	}
+	c.StrictConfig = getEnvBool("STRICT_CONFIG", c.StrictConfig)
+	// Malformed values were replaced by defaults; strict mode refuses them instead
+	if c.StrictConfig && len(envErrors) > 0 {
+		return errors.Join(envErrors...)
+	}
+	for _, err := range envErrors {
+		e := err.(envError)
+		slog.Warn("ignoring invalid environment variable", "key", e.key, "value", e.value, "want", e.want)
+	}
+	return nil
+}
+
+// validate rejects values the server can't run with and normalizes the rest
+func (c *Config) validate() error {
+	if _, _, err := parseListenAddr(c.ListenAddr); err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", c.ListenAddr, err)
+	}
+	if c.AccessLog != "" && c.AccessLog != "combined" {
+		return fmt.Errorf("unsupported access_log format %q (only \"combined\")", c.AccessLog)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls_cert and tls_key must be set together")
+	}
+	if c.EnablePprof {
+		if err := checkPprofAddr(c.PprofAddr); err != nil {
+			return err
+		}
+	}
+	if err := checkTrustedProxies(c.TrustedProxies); err != nil {
+		return err
+	}
+	if c.SOCKS5Proxy != "" {
+		if _, err := parseSOCKS5(c.SOCKS5Proxy); err != nil {
+			return err
+		}
+	}
+	if c.MaxProbeIPs < 1 {
+		return errors.New("max_probe_ips must be at least 1")
+	}
+	if c.MaxBodyBytes < 0 || c.MaxDNS < 0 || c.MaxICMP < 0 || c.MaxTCP < 0 || c.MaxUDP < 0 || c.MaxWorkers < 0 || c.MaxInflightRequests < 0 || c.InflightQueueWait < 0 || c.AcquireTimeout < 0 || c.GzipMinBytes < 0 || c.RateLimitBurst < 0 || c.RateLimitMaxClients < 0 {
+		return errors.New("semaphore sizes and rate limits must not be negative")
+	}
+	if c.CacheTTL < 0 || c.CacheNegTTL < 0 || c.CacheMaxEntries < 0 || c.IdempotencyTTL < 0 || c.IdempotencyMaxKeys < 0 || c.MaxMonitors < 0 || c.ScanMaxHosts < 0 || c.PortscanMaxPorts < 0 {
+		return errors.New("cache, idempotency, monitor and scan limits must not be negative")
+	}
+	if c.CacheNegTTL == 0 {
+		c.CacheNegTTL = c.CacheTTL / 4
+	}
+	if c.DoHEndpoint != "" && c.DNSServer != "" {
+		return errors.New("doh_endpoint and dns_server are mutually exclusive")
+	}
+	if c.DoHEndpoint != "" {
+		if u, err := url.Parse(c.DoHEndpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid doh_endpoint %q: must be an https:// URL", c.DoHEndpoint)
+		}
+	}
+	if c.DNSServer != "" {
+		if _, _, err := parseDNSServer(c.DNSServer); err != nil {
+			return fmt.Errorf("invalid dns_server: %w", err)
+		}
+	}
+	if c.ICMPRetries < 0 || c.ICMPRetries > maxICMPRetries {
+		return fmt.Errorf("icmp_retries must be 0-%d", maxICMPRetries)
+	}
+	if id := *c.ICMPID; id < 0 || id > 0xffff {
+		return errors.New("icmp_id must be 0-65535")
+	}
+	for family, s := range map[string]string{"4": c.SourceIPv4, "6": c.SourceIPv6} {
+		if s == "" {
+			continue
+		}
+		if _, err := parseSourceAddr(s, family); err != nil {
+			return err
+		}
+	}
+	var err error
+	if c.Ports, err = parsePorts(strings.Join(c.Ports, ",")); err != nil {
+		return fmt.Errorf("invalid ports: %w", err)
+	}
+	if c.UDPPorts, err = parsePorts(strings.Join(c.UDPPorts, ",")); err != nil {
+		return fmt.Errorf("invalid udp_ports: %w", err)
+	}
+	if c.ProbeOrder, err = parseProbeOrder(strings.Join(c.ProbeOrder, ",")); err != nil {
+		return fmt.Errorf("invalid probe_order: %w", err)
+	}
+	if _, err := parseBasicUsers(c.BasicAuthUsers); err != nil {
+		return fmt.Errorf("invalid basic_auth_users: %w", err)
+	}
+	for i, t := range c.ICMPAliveTypes {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "echo-reply" && !slices.Contains(aliveReplyTypes, t) {
+			return fmt.Errorf("invalid icmp_alive_types: unknown type %q (want %s)", t, strings.Join(aliveReplyTypes, ", "))
+		}
+		c.ICMPAliveTypes[i] = t
+	}
+	c.ProbeTimeout = duration(min(max(time.Duration(c.ProbeTimeout), minProbeTimeout), maxProbeTimeout))
+	if c.TCPDialTimeout < 0 || c.TCPDialTimeout > c.ProbeTimeout {
+		return fmt.Errorf("tcp_dial_timeout must be between 0 and probe_timeout (%s)", time.Duration(c.ProbeTimeout))
+	}
+	return nil
+}
+
+// sourceAddr returns the configured source address for family, nil when unset
+func (c Config) sourceAddr(family string) net.IP {
+	if family == "6" {
+		return net.ParseIP(c.SourceIPv6)
+	}
+	return net.ParseIP(c.SourceIPv4)
+}
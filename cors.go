@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// corsMiddleware adds CORS headers to /api responses for the allowed origins ("*" allows any)
+// and answers preflight requests. Returns nil when no origins are configured.
+func corsMiddleware(origins []string) gin.HandlerFunc {
+	if len(origins) == 0 {
+		return nil
+	}
+	anyOrigin := slices.Contains(origins, "*")
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" || !strings.HasPrefix(c.Request.URL.Path, "/api/") {
+			c.Next()
+			return
+		}
+		h := c.Writer.Header()
+		h.Add("Vary", "Origin")
+		if !anyOrigin && !slices.Contains(origins, origin) {
+			c.Next()
+			return
+		}
+		if anyOrigin {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		h.Set("Access-Control-Expose-Headers", "X-Request-ID, X-Cache, ETag, Retry-After, Idempotent-Replayed, X-Batch-Errors")
+		// Preflight: the API routes have no OPTIONS handlers, so answer it here
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Accept, X-Request-ID, Idempotency-Key")
+			h.Set("Access-Control-Max-Age", "600")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ipResolver resolves a host to addresses; *net.Resolver satisfies it
+type ipResolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// resolver is used for the A/AAAA lookups in detectAndPing
+var resolver ipResolver = net.DefaultResolver
+
+// netResolver answers the record types ipResolver can't express (CNAME, PTR, MX, ...) from the
+// same upstream as resolver: the DNS_SERVER resolver, DoH tunnelled through dohResolver.serve,
+// or the system's nameservers
+var netResolver = net.DefaultResolver
+
+// The upstream behind resolver, for queries net.Resolver can't express (/api/dns?ttl=1): the
+// DOH_ENDPOINT resolver, or the DNS_SERVER spec; neither set means the system's nameservers
+var (
+	upstreamDoH    *dohResolver
+	upstreamServer string
+)
+
+// setupResolver switches lookups to DNS-over-HTTPS when DOH_ENDPOINT is set, or to a fixed
+// server when DNS_SERVER is. Both were validated with the rest of the config.
+func setupResolver(c Config) {
+	if server := c.DNSServer; server != "" {
+		r, _ := newServerResolver(server)
+		resolver, netResolver, upstreamServer = r, r, server
+		slog.Info("resolving via fixed DNS server", "server", server)
+		return
+	}
+	ep := c.DoHEndpoint
+	if ep == "" {
+		return
+	}
+	upstreamDoH = &dohResolver{endpoint: ep, client: &http.Client{Timeout: 5 * time.Second}}
+	resolver, netResolver = upstreamDoH, upstreamDoH.netResolver()
+	slog.Info("resolving via DNS-over-HTTPS", "endpoint", ep)
+}
+
+// newServerResolver builds a resolver that sends every query to one server, given as
+// "ip[:port]" with an optional "udp://" or "tcp://" prefix. Without a prefix queries use UDP
+// and retry over TCP when truncated, like the system resolver.
+func newServerResolver(spec string) (*net.Resolver, error) {
+	forced, addr, err := parseDNSServer(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			if forced != "" {
+				network = forced
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}, nil
+}
+
+// parseDNSServer splits a DNS server spec ("[udp://|tcp://]ip[:port]") into the forced network
+// ("" when UDP with TCP retry) and host:port address
+func parseDNSServer(spec string) (network, addr string, err error) {
+	if scheme, rest, ok := strings.Cut(spec, "://"); ok {
+		if scheme != "udp" && scheme != "tcp" {
+			return "", "", fmt.Errorf("unsupported scheme %q (use udp:// or tcp://)", scheme)
+		}
+		network, spec = scheme, rest
+	}
+	host, port, err := net.SplitHostPort(spec)
+	if err != nil {
+		host, port = strings.Trim(spec, "[]"), "53"
+	}
+	if net.ParseIP(host) == nil {
+		return "", "", fmt.Errorf("dns server must be an IP address: %q", host)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", "", fmt.Errorf("invalid dns server port: %q", port)
+	}
+	return network, net.JoinHostPort(host, port), nil
+}
+
+// dohResolver performs RFC 8484 DNS-over-HTTPS queries (POST, application/dns-message)
+type dohResolver struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (r *dohResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	switch network {
+	case "ip4":
+		return r.query(ctx, host, dnsmessage.TypeA)
+	case "ip6":
+		return r.query(ctx, host, dnsmessage.TypeAAAA)
+	default:
+		v4, err4 := r.query(ctx, host, dnsmessage.TypeA)
+		v6, err6 := r.query(ctx, host, dnsmessage.TypeAAAA)
+		if len(v4)+len(v6) == 0 {
+			if err4 != nil {
+				return nil, err4
+			}
+			return nil, err6
+		}
+		return append(v4, v6...), nil
+	}
+}
+
+// netResolver returns a *net.Resolver whose queries, of any type, go to the DoH endpoint: each
+// connection it dials is served in memory by serve
+func (r *dohResolver) netResolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go r.serve(ctx, server)
+			return client, nil
+		},
+	}
+}
+
+// serve answers the length-prefixed DNS queries the Go resolver writes to a stream connection
+// by forwarding each to the DoH endpoint, until the resolver hangs up. A query the endpoint
+// can't answer gets a SERVFAIL, as from a recursive server that failed upstream.
+func (r *dohResolver) serve(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	var hdr [2]byte
+	for {
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		var q dnsmessage.Message
+		if q.Unpack(buf) != nil || len(q.Questions) == 0 {
+			return
+		}
+		host := q.Questions[0].Name.String()
+		m, err := r.exchange(ctx, host, q)
+		if err != nil && !m.Response {
+			m = dnsmessage.Message{Header: q.Header, Questions: q.Questions}
+			m.Response, m.RCode = true, dnsmessage.RCodeServerFailure
+		}
+		m.ID = q.ID
+		packed, err := m.Pack()
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packed))), packed...)); err != nil {
+			return
+		}
+	}
+}
+
+// query sends a single question and returns the A/AAAA answers
+func (r *dohResolver) query(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, error) {
+	q, err := newDNSQuery(host, qtype)
+	if err != nil {
+		return nil, err
+	}
+	m, err := r.exchange(ctx, host, q)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, a := range m.Answers {
+		switch b := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(b.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(b.AAAA[:]))
+		}
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+// newDNSQuery builds a recursive query for host's records of qtype
+func newDNSQuery(host string, qtype dnsmessage.Type) (dnsmessage.Message, error) {
+	fqdn := host
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	name, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return dnsmessage.Message{}, &net.DNSError{Err: err.Error(), Name: host}
+	}
+	return dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}, nil
+}
+
+// checkRCode turns a failure response code into the net.DNSError the system resolver would give
+func checkRCode(m *dnsmessage.Message, host string) error {
+	switch m.RCode {
+	case dnsmessage.RCodeSuccess:
+		return nil
+	case dnsmessage.RCodeNameError:
+		return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return &net.DNSError{Err: "server failure: " + m.RCode.String(), Name: host, IsTemporary: true}
+}
+
+// exchange sends q to the DoH endpoint and returns the successful response
+func (r *dohResolver) exchange(ctx context.Context, host string, q dnsmessage.Message) (dnsmessage.Message, error) {
+	packed, err := q.Pack()
+	if err != nil {
+		return dnsmessage.Message{}, &net.DNSError{Err: err.Error(), Name: host}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.endpoint, bytes.NewReader(packed))
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return dnsmessage.Message{}, &net.DNSError{Err: err.Error(), Name: host, IsTemporary: true}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return dnsmessage.Message{}, &net.DNSError{Err: fmt.Sprintf("doh server returned %s", resp.Status), Name: host, IsTemporary: true}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return dnsmessage.Message{}, &net.DNSError{Err: err.Error(), Name: host, IsTemporary: true}
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(body); err != nil {
+		return dnsmessage.Message{}, &net.DNSError{Err: "malformed doh response", Name: host}
+	}
+	return m, checkRCode(&m, host)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveDoH answers MX and PTR queries for the names in mx and ptr; anything else fails with a 500
+func serveDoH(t *testing.T, mx, ptr map[string]string) *dohResolver {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		var q dnsmessage.Message
+		if q.Unpack(body) != nil || len(q.Questions) != 1 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		qq := q.Questions[0]
+		h := dnsmessage.ResourceHeader{Name: qq.Name, Type: qq.Type, Class: dnsmessage.ClassINET, TTL: 60}
+		m := dnsmessage.Message{Header: dnsmessage.Header{ID: q.ID, Response: true}, Questions: q.Questions}
+		switch target := mx[qq.Name.String()] + ptr[qq.Name.String()]; {
+		case target == "":
+			http.Error(w, "upstream failed", http.StatusInternalServerError)
+			return
+		case qq.Type == dnsmessage.TypeMX:
+			m.Answers = append(m.Answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.MXResource{Pref: 10, MX: dnsmessage.MustNewName(target)}})
+		case qq.Type == dnsmessage.TypePTR:
+			m.Answers = append(m.Answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(target)}})
+		}
+		out, _ := m.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(out)
+	}))
+	t.Cleanup(srv.Close)
+	return &dohResolver{endpoint: srv.URL, client: srv.Client()}
+}
+
+func TestDoHNetResolver(t *testing.T) {
+	doh := serveDoH(t,
+		map[string]string{"example.test.": "mail.example.test."},
+		map[string]string{"1.2.0.192.in-addr.arpa.": "host.example.test."})
+	r := doh.netResolver()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	mxs, err := r.LookupMX(ctx, "example.test.")
+	if err != nil || len(mxs) != 1 || mxs[0].Host != "mail.example.test." || mxs[0].Pref != 10 {
+		t.Errorf("LookupMX = %v, %v", mxs, err)
+	}
+	names, err := r.LookupAddr(ctx, "192.0.2.1")
+	if err != nil || len(names) != 1 || names[0] != "host.example.test." {
+		t.Errorf("LookupAddr = %v, %v", names, err)
+	}
+	start := time.Now()
+	if _, err := r.LookupTXT(ctx, "missing.test."); err == nil {
+		t.Error("LookupTXT through a failing endpoint succeeded")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("a failing endpoint took %v to report", d)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsLookupResult is the data of /api/dns; Records depends on Type
+type dnsLookupResult struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Records any    `json:"records"`
+	Answers *int   `json:"answers,omitempty"` // answer section size, CNAMEs included (ttl=1)
+	Server  string `json:"server,omitempty"`  // server that answered (ttl=1)
+	Error   string `json:"error,omitempty"`
+}
+
+type mxRecord struct {
+	Host string `json:"host"`
+	Pref uint16 `json:"pref"`
+}
+
+type srvRecord struct {
+	Target   string `json:"target"`
+	Port     uint16 `json:"port"`
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+}
+
+// addressTypes is the type of a lookup without ?type=: the A and AAAA records together, the
+// addresses a probe of the name would use
+const addressTypes = "A/AAAA"
+
+// handleDNSLookup serves GET /api/dns?name=example.com&type=A|AAAA|MX|SRV|TXT|CNAME|NS, looking
+// up both A and AAAA when type is omitted. With ttl=1, addresses are queried directly so each
+// comes with its TTL.
+func handleDNSLookup(c *gin.Context) {
+	qtype := strings.ToUpper(strings.TrimSpace(c.Query("type")))
+	if qtype == "" {
+		qtype = addressTypes
+	}
+	name, ok := normalizeServiceName(strings.TrimSpace(c.Query("name")))
+	if !ok {
+		abortWithError(c, 400, "invalid name")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(cfg.ProbeTimeout))
+	defer cancel()
+	if !acquire(ctx, semDNS) {
+		abortCancelled(c, ctx, "dns lookup")
+		return
+	}
+	defer release(semDNS)
+
+	res := dnsLookupResult{Name: name, Type: qtype}
+	var err error
+	r := netResolver
+	switch qtype {
+	case "A", "AAAA", addressTypes:
+		family, dtypes := "ip", []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+		switch qtype {
+		case "A":
+			family, dtypes = "ip4", dtypes[:1]
+		case "AAAA":
+			family, dtypes = "ip6", dtypes[1:]
+		}
+		if c.Query("ttl") == "1" {
+			recs := []ttlRecord{}
+			var answers int
+			for _, t := range dtypes {
+				found, n, server, lerr := lookupTTL(ctx, name, t)
+				recs, answers, res.Server = append(recs, found...), answers+n, server
+				if err == nil {
+					err = lerr
+				}
+			}
+			// Either family answering is an answer, as for a resolver's "ip" lookup
+			if len(recs) > 0 {
+				err = nil
+			}
+			res.Records, res.Answers = recs, &answers
+			break
+		}
+		var ips []net.IP
+		ips, err = resolver.LookupIP(ctx, family, name)
+		res.Records = ipStrings(ips)
+	case "MX":
+		var mxs []*net.MX
+		mxs, err = r.LookupMX(ctx, name)
+		recs := make([]mxRecord, 0, len(mxs))
+		for _, mx := range mxs {
+			recs = append(recs, mxRecord{Host: strings.TrimSuffix(mx.Host, "."), Pref: mx.Pref})
+		}
+		res.Records = recs
+	case "SRV":
+		var srvs []*net.SRV
+		_, srvs, err = r.LookupSRV(ctx, "", "", name)
+		recs := make([]srvRecord, 0, len(srvs))
+		for _, s := range srvs {
+			recs = append(recs, srvRecord{Target: strings.TrimSuffix(s.Target, "."), Port: s.Port, Priority: s.Priority, Weight: s.Weight})
+		}
+		res.Records = recs
+	case "TXT":
+		var txts []string
+		txts, err = r.LookupTXT(ctx, name)
+		res.Records = append([]string{}, txts...)
+	case "CNAME":
+		var cname string
+		cname, err = r.LookupCNAME(ctx, name)
+		recs := []string{}
+		// LookupCNAME returns the name itself when there is no CNAME
+		if cname = strings.TrimSuffix(cname, "."); err == nil && !strings.EqualFold(cname, name) {
+			recs = append(recs, cname)
+		}
+		res.Records = recs
+	case "NS":
+		var nss []*net.NS
+		nss, err = r.LookupNS(ctx, name)
+		recs := make([]string, 0, len(nss))
+		for _, ns := range nss {
+			recs = append(recs, strings.TrimSuffix(ns.Host, "."))
+		}
+		res.Records = recs
+	default:
+		abortWithError(c, 400, "type must be one of A, AAAA, MX, SRV, TXT, CNAME, NS")
+		return
+	}
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			res.Error = "dns: no such record"
+		} else {
+			res.Error = "dns: " + err.Error()
+		}
+	}
+	c.JSON(200, apiResponse{Code: 200, Msg: "success", Data: res})
+}
+
+// normalizeServiceName IDNA-normalizes a DNS name, allowing the leading "_service._proto"
+// labels used by SRV names
+func normalizeServiceName(s string) (string, bool) {
+	s = strings.TrimSuffix(s, ".")
+	var prefix []string
+	for strings.HasPrefix(s, "_") {
+		label, rest, ok := strings.Cut(s, ".")
+		if !ok || len(label) < 2 || len(label) > 63 || !reDomain.MatchString(label[1:]) {
+			return "", false
+		}
+		prefix = append(prefix, label)
+		s = rest
+	}
+	host, ok := normalizeDomain(s)
+	if !ok {
+		return "", false
+	}
+	return strings.Join(append(prefix, host), "."), true
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ttlRecord is one A/AAAA answer of /api/dns?ttl=1
+type ttlRecord struct {
+	Address string `json:"address"`
+	TTL     uint32 `json:"ttl"` // seconds left, as given by the answering server
+}
+
+// resolvConf lists the system's nameservers, used for raw queries when neither DOH_ENDPOINT
+// nor DNS_SERVER is set
+const resolvConf = "/etc/resolv.conf"
+
+// maxUDPResponse is the largest DNS response read over UDP; the queries carry no EDNS0 option,
+// so servers truncate at 512 bytes and the answer is fetched again over TCP
+const maxUDPResponse = 512
+
+// lookupTTL resolves host's A or AAAA records with a query of its own, since net.Resolver drops
+// the TTLs. It also returns the size of the answer section, which counts the CNAMEs followed
+// on the way, and the server that answered.
+func lookupTTL(ctx context.Context, host string, qtype dnsmessage.Type) (recs []ttlRecord, answers int, server string, err error) {
+	q, err := newDNSQuery(host, qtype)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	var m dnsmessage.Message
+	if upstreamDoH != nil {
+		server = upstreamDoH.endpoint
+		m, err = upstreamDoH.exchange(ctx, host, q)
+	} else {
+		network, addr := "", systemNameserver()
+		if upstreamServer != "" {
+			// validated at startup
+			network, addr, _ = parseDNSServer(upstreamServer)
+		}
+		server = addr
+		m, err = exchangeServer(ctx, network, addr, host, q)
+	}
+	if err != nil {
+		return nil, 0, server, err
+	}
+	recs = []ttlRecord{}
+	for _, a := range m.Answers {
+		switch b := a.Body.(type) {
+		case *dnsmessage.AResource:
+			recs = append(recs, ttlRecord{Address: net.IP(b.A[:]).String(), TTL: a.Header.TTL})
+		case *dnsmessage.AAAAResource:
+			recs = append(recs, ttlRecord{Address: net.IP(b.AAAA[:]).String(), TTL: a.Header.TTL})
+		}
+	}
+	if len(recs) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return recs, len(m.Answers), server, err
+}
+
+// exchangeServer sends q to a DNS server over network ("" for UDP, retried over TCP when the
+// response is truncated) and returns the successful response
+func exchangeServer(ctx context.Context, network, addr, host string, q dnsmessage.Message) (dnsmessage.Message, error) {
+	q.ID = uint16(rand.Uint32())
+	packed, err := q.Pack()
+	if err != nil {
+		return dnsmessage.Message{}, &net.DNSError{Err: err.Error(), Name: host}
+	}
+	if network == "" {
+		m, err := roundTripDNS(ctx, "udp", addr, packed)
+		if err != nil || !m.Truncated {
+			return checkResponse(m, err, q, host, addr)
+		}
+		network = "tcp"
+	}
+	m, err := roundTripDNS(ctx, network, addr, packed)
+	return checkResponse(m, err, q, host, addr)
+}
+
+// roundTripDNS writes one packed query to addr and reads the response, framing both with a
+// length prefix over TCP
+func roundTripDNS(ctx context.Context, network, addr string, packed []byte) (dnsmessage.Message, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	var buf []byte
+	if network == "tcp" {
+		msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(packed)), uint16(len(packed)))
+		if _, err := conn.Write(append(msg, packed...)); err != nil {
+			return dnsmessage.Message{}, err
+		}
+		var n [2]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return dnsmessage.Message{}, err
+		}
+		buf = make([]byte, binary.BigEndian.Uint16(n[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return dnsmessage.Message{}, err
+		}
+	} else {
+		if _, err := conn.Write(packed); err != nil {
+			return dnsmessage.Message{}, err
+		}
+		buf = make([]byte, maxUDPResponse)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return dnsmessage.Message{}, err
+		}
+		buf = buf[:n]
+	}
+	var m dnsmessage.Message
+	err = m.Unpack(buf)
+	return m, err
+}
+
+// checkResponse accepts m only as the answer to q, mapping transport and server failures to
+// the net.DNSError the system resolver would give
+func checkResponse(m dnsmessage.Message, err error, q dnsmessage.Message, host, addr string) (dnsmessage.Message, error) {
+	if err != nil {
+		var ne net.Error
+		timeout := errors.As(err, &ne) && ne.Timeout()
+		return m, &net.DNSError{Err: err.Error(), Name: host, Server: addr, IsTimeout: timeout, IsTemporary: true}
+	}
+	if !m.Response || m.ID != q.ID || len(m.Questions) != 1 || m.Questions[0] != q.Questions[0] {
+		return m, &net.DNSError{Err: "mismatched response", Name: host, Server: addr}
+	}
+	return m, checkRCode(&m, host)
+}
+
+// systemNameserver returns the first nameserver in resolv.conf as host:port, falling back to a
+// local resolver like the Go resolver does
+func systemNameserver() string {
+	if f, err := os.Open(resolvConf); err == nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			fields := strings.Fields(sc.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				if ip := net.ParseIP(fields[1]); ip != nil {
+					return net.JoinHostPort(ip.String(), "53")
+				}
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
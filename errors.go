@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every rejected request is answered through abortWithError, with these statuses: 400 for
+// invalid input, 401 for missing credentials, 403 for refused targets, 413 for oversized
+// bodies, 422 for a reused Idempotency-Key, 429 when rate limited, 503 when capacity is
+// exhausted (with Retry-After) and 504 when the deadline ran out first.
+
+// textErrors reports whether c's client reads errors as a plain line rather than {code, msg}:
+// the text endpoint /api/ping unless JSON was negotiated, elsewhere only an Accept header
+// preferring text/plain over JSON
+func textErrors(c *gin.Context) bool {
+	if c.FullPath() == "/api/ping" {
+		return wantsPretty(c) || c.NegotiateFormat(pingFormats...) != gin.MIMEJSON
+	}
+	return c.NegotiateFormat(gin.MIMEJSON, gin.MIMEPlain) == gin.MIMEPlain
+}
+
+// errorBody renders an error response for c's client, for writers that bypass gin's renderers
+func errorBody(c *gin.Context, status int, msg string) (contentType string, body []byte) {
+	if textErrors(c) {
+		return gin.MIMEPlain + "; charset=utf-8", []byte(msg)
+	}
+	body, _ = json.Marshal(apiResponse{Code: status, Msg: msg})
+	return gin.MIMEJSON + "; charset=utf-8", body
+}
+
+// abortWithError answers c with status and msg, as {code, msg} JSON or a plain line (see
+// textErrors), and stops the handler chain
+func abortWithError(c *gin.Context, status int, msg string) {
+	ct, body := errorBody(c, status, msg)
+	c.Abort()
+	c.Data(status, ct, body)
+}
+
+// abortCancelled answers a request whose probe could not start before ctx ended: 504 when the
+// deadline ran out, 503 otherwise
+func abortCancelled(c *gin.Context, ctx context.Context, what string) {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		abortWithError(c, 504, what+" timed out")
+		return
+	}
+	abortWithError(c, 503, what+" cancelled")
+}
+
+// handleNotFound answers unknown routes in the same shape as every other error
+func handleNotFound(c *gin.Context) {
+	abortWithError(c, 404, "not found")
+}
+
+// handlePanic answers a request whose handler panicked; gin.CustomRecovery has logged it
+func handlePanic(c *gin.Context, _ any) {
+	abortWithError(c, 500, "internal error")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mimeCSV is the media type for CSV renderings of ping results
+const mimeCSV = "text/csv"
+
+// formatPretty is the ?format=pretty report: aligned plain text meant for a terminal
+const formatPretty = "pretty"
+
+// pingFormats are the representations /api/ping can negotiate, the first being the default
+// when the client sends no Accept header
+var pingFormats = []string{gin.MIMEPlain, gin.MIMEJSON, mimeCSV}
+
+// pingFormat picks the /api/ping representation: ?format=pretty, else the Accept header,
+// keeping the legacy plain text when nothing offered is acceptable
+func pingFormat(c *gin.Context) string {
+	if wantsPretty(c) {
+		return formatPretty
+	}
+	c.Writer.Header().Add("Vary", "Accept")
+	if f := c.NegotiateFormat(pingFormats...); f != "" {
+		return f
+	}
+	return gin.MIMEPlain
+}
+
+// csvHeader names the columns written by csvRecord
+var csvHeader = []string{"input", "ipv4", "ipv6", "ipv4_rtt_ms", "ipv6_rtt_ms"}
+
+// csvRecord flattens the summary fields of a result into one CSV record
+func (r *pingResult) csvRecord(input string) []string {
+	ms := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	return []string{input, string(r.IPv4), string(r.IPv6), ms(r.IPv4RTTms), ms(r.IPv6RTTms)}
+}
+
+// wantsCSV reports whether the client asked for CSV (?format=csv or Accept: text/csv)
+func wantsCSV(c *gin.Context) bool {
+	return c.Query("format") == "csv" || strings.Contains(c.GetHeader("Accept"), mimeCSV)
+}
+
+// wantsPretty reports whether the client asked for the terminal report (?format=pretty)
+func wantsPretty(c *gin.Context) bool {
+	return c.Query("format") == formatPretty
+}
+
+// writePretty renders one report block per result, separated by blank lines: the input, then
+// one row per family with status, RTT, method and probed addresses, then any notes. Columns
+// are padded to the widest cell in the whole report, so blocks line up with each other and
+// equal results always render identically.
+func writePretty(w io.Writer, results []batchResult) {
+	rows := make([][2][]string, len(results))
+	var width [4]int
+	for i, r := range results {
+		for j, f := range []struct {
+			name   string
+			status Status
+			rtt    float64
+			method string
+			addrs  []string
+		}{
+			{"IPv4", r.IPv4, r.IPv4RTTms, r.IPv4Method, r.IPv4Addrs},
+			{"IPv6", r.IPv6, r.IPv6RTTms, r.IPv6Method, r.IPv6Addrs},
+		} {
+			rtt, method, addrs := "-", "-", "-"
+			if f.rtt >= 0 {
+				rtt = strconv.FormatFloat(f.rtt, 'f', 2, 64) + " ms"
+			}
+			if f.method != "" {
+				method = f.method
+			}
+			if len(f.addrs) > 0 {
+				addrs = strings.Join(f.addrs, ", ")
+			}
+			rows[i][j] = []string{f.name, string(f.status), rtt, method, addrs}
+			for k := range width {
+				width[k] = max(width[k], len(rows[i][j][k]))
+			}
+		}
+	}
+	bw := bufio.NewWriter(w)
+	for i, r := range results {
+		if i > 0 {
+			bw.WriteString("\n")
+		}
+		bw.WriteString(r.Input + "\n")
+		for _, row := range rows[i] {
+			// The RTT column is right-aligned so the decimal points line up
+			fmt.Fprintf(bw, "  %-*s  %-*s  %*s  %-*s  %s\n",
+				width[0], row[0], width[1], row[1], width[2], row[2], width[3], row[3], row[4])
+		}
+		if r.Error != "" {
+			bw.WriteString("  error: " + r.Error + "\n")
+		}
+		if r.TimedOut {
+			bw.WriteString("  note: timed out before every probe finished\n")
+		}
+		if r.NoLocalIPv6 {
+			bw.WriteString("  note: IPv6 not probed, this server has no IPv6 address\n")
+		}
+	}
+	_ = bw.Flush()
+}
+
+// writePingJSON sends res in the apiResponse envelope, with the message reflecting a timeout
+func writePingJSON(c *gin.Context, res pingResult) {
+	if status := res.httpStatus(); status != 200 {
+		c.JSON(status, apiResponse{Code: status, Msg: "timeout", Data: res})
+		return
+	}
+	c.JSON(200, apiResponse{Code: 200, Msg: "success", Data: res})
+}
+
+// writePing renders res for input in the negotiated format
+func writePing(c *gin.Context, format, input string, res pingResult) {
+	switch format {
+	case gin.MIMEJSON:
+		writePingJSON(c, res)
+	case formatPretty:
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		c.Status(res.httpStatus())
+		writePretty(c.Writer, []batchResult{{Input: input, pingResult: res}})
+	case mimeCSV:
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(res.httpStatus())
+		w := csv.NewWriter(c.Writer)
+		_ = w.Write(csvHeader)
+		_ = w.Write(res.csvRecord(input))
+		w.Flush()
+	default:
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		c.String(res.httpStatus(), "ipv4:%s,ipv6:%s", res.legacyStatus("4"), res.legacyStatus("6"))
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log/slog"
+	"net/netip"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoDB is opened once at startup from GEOIP_DB; nil disables enrichment
+var geoDB *maxminddb.Reader
+
+// geoInfo is the country/ASN of one probed address
+type geoInfo struct {
+	Country string `json:"country,omitempty"` // ISO 3166-1 alpha-2
+	ASN     uint   `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+// geoRecord decodes both GeoLite2-Country/City and GeoLite2-ASN layouts (or a merged DB)
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// setupGeoIP opens the MaxMind database named by GEOIP_DB. A missing or unreadable file
+// only logs a warning: enrichment is optional and must never fail requests.
+func setupGeoIP(path string) {
+	if path == "" {
+		return
+	}
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		slog.Warn("GeoIP database unavailable, skipping enrichment", "path", path, "err", err)
+		return
+	}
+	geoDB = db
+	slog.Info("GeoIP enrichment enabled", "path", path, "type", db.Metadata.DatabaseType)
+}
+
+// geoLookup maps each address to its country/ASN; addresses without a record are omitted
+func geoLookup(addrs []string) map[string]geoInfo {
+	if geoDB == nil || len(addrs) == 0 {
+		return nil
+	}
+	out := make(map[string]geoInfo, len(addrs))
+	for _, a := range addrs {
+		ip, err := netip.ParseAddr(a)
+		if err != nil {
+			continue
+		}
+		var rec geoRecord
+		if err := geoDB.Lookup(ip.WithZone("").AsSlice(), &rec); err != nil {
+			continue
+		}
+		if rec.Country.ISOCode == "" && rec.ASN == 0 {
+			continue
+		}
+		out[a] = geoInfo{Country: rec.Country.ISOCode, ASN: rec.ASN, ASOrg: rec.ASOrg}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultGzipMinBytes is the smallest response worth compressing when GZIP_MIN_BYTES is unset;
+// below it the gzip header and deflate overhead outweigh the saving
+const defaultGzipMinBytes = 1024
+
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip (with a nonzero q)
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") && strings.TrimSpace(coding) != "*" {
+			continue
+		}
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.EqualFold(strings.TrimSpace(k), "q") {
+			if q, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil && q == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipMiddleware compresses responses for clients sending Accept-Encoding: gzip. The body is
+// held back until minBytes have been written, so small single results go out as they are.
+// A flush commits early: NDJSON and CSV streams are compressed with a sync flush per record,
+// so each still arrives as soon as it is written; SSE is never compressed, as proxies and
+// EventSource implementations buffer compressed event streams.
+func gzipMiddleware(minBytes int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Upgrades hijack the connection, and ranges address bytes of the identity encoding
+		if c.Request.Method == http.MethodHead || c.GetHeader("Upgrade") != "" || c.GetHeader("Range") != "" {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(c.GetHeader("Accept-Encoding")) {
+			c.Next()
+			return
+		}
+		w := &gzipWriter{ResponseWriter: c.Writer, minBytes: minBytes}
+		c.Writer = w
+		defer w.finish()
+		c.Next()
+	}
+}
+
+// gzipWriter buffers the start of a response until it knows whether to compress it
+type gzipWriter struct {
+	gin.ResponseWriter
+	minBytes int
+	buf      []byte
+	decided  bool
+	gz       *gzip.Writer // set once the response is being compressed
+}
+
+// decide commits to compressing or not and writes out whatever was held back
+func (w *gzipWriter) decide(compress bool) error {
+	w.decided = true
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" || strings.HasPrefix(h.Get("Content-Type"), "text/event-stream") {
+		compress = false
+	}
+	if status := w.Status(); status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent {
+		compress = false
+	}
+	if compress {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		// The same entity is no longer byte-identical, so its validator can only be weak
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := w.write(buf)
+	return err
+}
+
+func (w *gzipWriter) write(p []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *gzipWriter) Write(p []byte) (int, error) {
+	if w.decided {
+		return w.write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.minBytes {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush commits to compression (a flushing handler is streaming) and pushes out what is
+// pending, including the compressor's buffered block
+func (w *gzipWriter) Flush() {
+	if !w.decided {
+		_ = w.decide(true)
+	}
+	if w.gz != nil {
+		_ = w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Unwrap lets http.ResponseController reach the connection for deadlines
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish sends a response that never reached minBytes uncompressed and completes the gzip
+// stream of one that did
+func (w *gzipWriter) finish() {
+	if !w.decided {
+		_ = w.decide(false)
+	}
+	if w.gz != nil {
+		_ = w.gz.Close()
+		w.gz.Reset(nil)
+		gzipWriters.Put(w.gz)
+		w.gz = nil
+	}
+}
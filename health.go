@@ -0,0 +1,33 @@
+package main
+
+import "github.com/gin-gonic/gin"
+
+// handleHealthz reports that the process is up
+func handleHealthz(c *gin.Context) {
+	c.String(200, "ok")
+}
+
+// handleReadyz reports whether probes can run: ICMP sockets (datagram or raw) opened at startup and no
+// semaphore fully saturated. The ICMPv6 socket is only required on hosts that probe IPv6 at all
+// (see ipv6Usable). Returns 503 otherwise.
+func handleReadyz(c *gin.Context) {
+	checks := map[string]bool{
+		"icmp4": icmp4 != nil,
+		"dns":   !semDNS.saturated(),
+		"icmp":  !semICMP.saturated(),
+		"tcp":   !semTCP.saturated(),
+		"udp":   !semUDP.saturated(),
+	}
+	if ipv6Usable {
+		checks["icmp6"] = icmp6 != nil
+	}
+	ready := true
+	for _, ok := range checks {
+		ready = ready && ok
+	}
+	if !ready {
+		c.JSON(503, apiResponse{Code: 503, Msg: "not ready", Data: checks})
+		return
+	}
+	c.JSON(200, apiResponse{Code: 200, Msg: "ready", Data: checks})
+}
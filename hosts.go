@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+)
+
+// staticHosts maps normalized names from HOSTS_FILE to their pinned addresses; nil when unset
+var staticHosts map[string][]net.IP
+
+// hostsResolver answers names pinned in HOSTS_FILE from memory and hands the rest to next
+type hostsResolver struct {
+	hosts map[string][]net.IP
+	next  ipResolver
+}
+
+func (r hostsResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	name, _ := normalizeDomain(host)
+	ips, ok := r.hosts[name]
+	if !ok {
+		return r.next.LookupIP(ctx, network, host)
+	}
+	// A pinned name without an address of the wanted family has none, rather than asking DNS
+	var out []net.IP
+	for _, ip := range ips {
+		if network == "ip" || (ip.To4() != nil) == (network == "ip4") {
+			out = append(out, ip)
+		}
+	}
+	return out, nil
+}
+
+// withHosts puts the HOSTS_FILE entries in front of r
+func withHosts(r ipResolver) ipResolver {
+	if staticHosts == nil {
+		return r
+	}
+	return hostsResolver{hosts: staticHosts, next: r}
+}
+
+// setupHostsFile loads HOSTS_FILE once and pins its names in front of the configured resolver.
+// An unreadable or malformed file is fatal: the point of pinning is deterministic targets.
+func setupHostsFile(path string) {
+	if path == "" {
+		return
+	}
+	hosts, err := loadHostsFile(path)
+	if err != nil {
+		fatal("invalid HOSTS_FILE", "path", path, "err", err)
+	}
+	staticHosts = hosts
+	resolver = withHosts(resolver)
+	slog.Info("static hosts pinned", "path", path, "names", len(hosts))
+}
+
+// loadHostsFile parses "name ip [ip...]" lines, also accepting the /etc/hosts order
+// "ip name [alias...]". Blank lines and # comments are skipped; addresses for a name that
+// appears more than once accumulate.
+func loadHostsFile(path string) (map[string][]net.IP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hosts := make(map[string][]net.IP)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: want a name and an address", n)
+		}
+		var names, addrs []string
+		if net.ParseIP(fields[0]) != nil {
+			addrs, names = fields[:1], fields[1:]
+		} else {
+			names, addrs = fields[:1], fields[1:]
+		}
+		ips := make([]net.IP, 0, len(addrs))
+		for _, a := range addrs {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, fmt.Errorf("line %d: invalid address %q", n, a)
+			}
+			ips = append(ips, ip)
+		}
+		for _, name := range names {
+			host, ok := normalizeDomain(name)
+			if !ok {
+				return nil, fmt.Errorf("line %d: invalid name %q", n, name)
+			}
+			hosts[host] = append(hosts[host], ips...)
+		}
+	}
+	return hosts, sc.Err()
+}
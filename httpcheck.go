@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxHTTPRedirects caps how many redirects /api/http follows
+const maxHTTPRedirects = 5
+
+// httpCheckResult is the /api/http response payload
+type httpCheckResult struct {
+	URL        string  `json:"url"`
+	Reachable  bool    `json:"reachable"`
+	Method     string  `json:"method,omitempty"` // HEAD, or GET when HEAD was refused
+	StatusCode int     `json:"status_code,omitempty"`
+	FinalURL   string  `json:"final_url,omitempty"`
+	Redirects  int     `json:"redirects"`
+	TLSVersion string  `json:"tls_version,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// normalizeHTTPURL validates an http(s) URL and rewrites its host to IDNA ASCII form
+func normalizeHTTPURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("url must be an absolute http:// or https:// URL")
+	}
+	host := u.Hostname()
+	if !isValidInput(host) {
+		return nil, errors.New("invalid host in url")
+	}
+	if parseIPAddr(host) == nil {
+		host, _ = normalizeDomain(host)
+	}
+	switch {
+	case u.Port() != "":
+		u.Host = net.JoinHostPort(host, u.Port())
+	case strings.Contains(host, ":"):
+		u.Host = "[" + host + "]"
+	default:
+		u.Host = host
+	}
+	u.User = nil
+	return u, nil
+}
+
+// httpCheck issues HEAD (falling back to GET when HEAD is rejected) and follows redirects
+func httpCheck(ctx context.Context, u *url.URL, timeout time.Duration) httpCheckResult {
+	res := httpCheckResult{URL: u.String()}
+	redirects := 0
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, DisableKeepAlives: true, TLSHandshakeTimeout: timeout},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxHTTPRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxHTTPRedirects)
+			}
+			redirects = len(via)
+			return nil
+		},
+	}
+
+	start := time.Now()
+	var resp *http.Response
+	var err error
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		redirects = 0
+		req, rerr := http.NewRequestWithContext(ctx, method, u.String(), nil)
+		if rerr != nil {
+			res.Error = rerr.Error()
+			return res
+		}
+		req.Header.Set("User-Agent", "ipcheck/1.0")
+		resp, err = client.Do(req)
+		res.Method = method
+		if err != nil || resp.StatusCode != http.StatusMethodNotAllowed && resp.StatusCode != http.StatusNotImplemented {
+			break
+		}
+		if method == http.MethodHead {
+			resp.Body.Close()
+		}
+	}
+	res.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer resp.Body.Close()
+
+	res.Reachable = true
+	res.StatusCode = resp.StatusCode
+	res.FinalURL = resp.Request.URL.String()
+	res.Redirects = redirects
+	if resp.TLS != nil {
+		res.TLSVersion = tls.VersionName(resp.TLS.Version)
+	}
+	return res
+}
+
+// handleHTTPCheck serves GET /api/http?url=https://example.com
+func handleHTTPCheck(c *gin.Context) {
+	u, err := normalizeHTTPURL(strings.TrimSpace(c.Query("url")))
+	if err != nil {
+		abortWithError(c, 400, err.Error())
+		return
+	}
+	opts, err := parseProbeOptions(c)
+	if err != nil {
+		abortWithError(c, 400, err.Error())
+		return
+	}
+	ctx := c.Request.Context()
+	if !acquire(ctx, semTCP) {
+		abortCancelled(c, ctx, "http check")
+		return
+	}
+	defer release(semTCP)
+	c.JSON(200, apiResponse{Code: 200, Msg: "success", Data: httpCheck(ctx, u, opts.Timeout)})
+}
@@ -0,0 +1,654 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Shared ICMP sockets (nil when neither datagram nor raw ICMP sockets are permitted)
+var (
+	icmp4 *icmpListener
+	icmp6 *icmpListener
+)
+
+// echoSeq hands out sequence numbers so concurrent probes never share an (ID, Seq) pair;
+// echoSeqSkips counts pairs passed over because they wrapped around onto an echo still awaiting
+// its reply
+var (
+	echoSeq      atomic.Uint32
+	echoSeqSkips atomic.Uint64
+)
+
+// nextEcho allocates the identifier and sequence number for one probe. Both advance together
+// from the ICMP_ID base, so instances sharing a raw-socket namespace produce the same
+// (ID, Seq) pair only if they were given the same base.
+func nextEcho() (id, seq int) {
+	n := echoSeq.Add(1)
+	return int((uint32(*cfg.ICMPID) + n) & 0xffff), int(n & 0xffff)
+}
+
+// echoKey identifies an outstanding echo request
+type echoKey struct{ id, seq int }
+
+// echoReply is handed from the read loop to the probe waiting on it
+type echoReply struct {
+	at      time.Time
+	rtt     time.Duration
+	ttl     int        // TTL / hop limit of the reply, 0 when control messages are unavailable
+	from    net.IP     // source address of the reply, nil when the socket didn't report it
+	spoofed bool       // the reply came from an address other than the one the request was sent to
+	data    *[]byte    // payload the reply carried back, from replyBufs; nil once echo has compared it
+	trunc   bool       // the reply was larger than the read buffer, i.e. than any echo we send
+	alive   string     // the non-echo reply type accepted in place of an echo reply (ICMP_ALIVE_TYPES)
+	mangled bool       // data differs from the payload that was sent
+	err     *icmpError // set instead of a reply when a router reported the echo undeliverable
+}
+
+// defaultEchoPayload is the echo data sent when a request sets no ?pattern=
+var defaultEchoPayload = []byte("ping")
+
+// echoPatternSize is the payload length a ?pattern= is repeated to fill: the 56 data bytes
+// system ping sends by default, so the pattern covers the body of a typical packet
+const echoPatternSize = 56
+
+// Echo buffer sizing. An echo we send carries at most echoPatternSize bytes, so its reply fits
+// in echoHeaderLen+echoPatternSize; an ICMP error quotes the original IP header (up to
+// maxIPHeaderLen with options) and echo header ahead of that, which is all innerEcho reads.
+const (
+	echoHeaderLen  = 8
+	maxIPHeaderLen = 60
+	maxICMPMessage = 65535 - 20 // an IPv4 datagram's largest payload
+)
+
+// echoBufSize is the read buffer for replies to echoes of up to payload bytes. It has one spare
+// byte, so a read that fills it completely was truncated by the kernel.
+func echoBufSize(payload int) int {
+	return min(echoHeaderLen+maxIPHeaderLen+echoHeaderLen+payload+1, maxICMPMessage)
+}
+
+// Pooled buffers, so probes under high concurrency don't each leave garbage behind: readBufs
+// for whole ICMP messages (traceroute rounds), replyBufs for the echo data the read loop hands
+// to a probe
+var (
+	readBufs  = sync.Pool{New: func() any { b := make([]byte, echoBufSize(echoPatternSize)); return &b }}
+	replyBufs = sync.Pool{New: func() any { b := make([]byte, 0, echoPatternSize); return &b }}
+)
+
+// parseEchoPattern decodes a ?pattern= hex string (1-16 bytes, like ping -p) and repeats it to
+// echoPatternSize bytes
+func parseEchoPattern(s string) ([]byte, error) {
+	p, err := hex.DecodeString(s)
+	if err != nil || len(p) == 0 || len(p) > 16 {
+		return nil, fmt.Errorf("pattern must be 1-16 bytes of hex: %q", s)
+	}
+	return bytes.Repeat(p, (echoPatternSize+len(p)-1)/len(p))[:echoPatternSize], nil
+}
+
+// icmpError is a Destination Unreachable or Time Exceeded message quoting one of our echoes
+type icmpError struct {
+	Type   string `json:"type"`   // "unreachable" or "time_exceeded"
+	Code   int    `json:"code"`   // ICMP code of the error message
+	Reason string `json:"reason"` // human-readable code
+	From   string `json:"from"`   // router or host that sent the error
+}
+
+// ICMPv4 / ICMPv6 Destination Unreachable codes (RFC 792, RFC 1812, RFC 4443)
+var (
+	unreachReasons4 = map[int]string{
+		0: "network unreachable", 1: "host unreachable", 2: "protocol unreachable", 3: "port unreachable",
+		4: "fragmentation needed", 5: "source route failed", 6: "destination network unknown",
+		7: "destination host unknown", 9: "network administratively prohibited",
+		10: "host administratively prohibited", 13: "communication administratively prohibited",
+	}
+	unreachReasons6 = map[int]string{
+		0: "no route to destination", 1: "administratively prohibited", 2: "beyond scope of source address",
+		3: "address unreachable", 4: "port unreachable", 5: "source address failed ingress/egress policy",
+		6: "reject route to destination",
+	}
+)
+
+// aliveReplyTypes are the non-echo answers ICMP_ALIVE_TYPES may accept as proof a host is up,
+// for networks where hosts answer echoes unusually: a time exceeded (from the last hop, when a
+// TTL is miscomputed), or an IPv4 timestamp or address mask reply. Echo replies always count.
+var aliveReplyTypes = []string{"time-exceeded", "timestamp-reply", "address-mask-reply"}
+
+// acceptsAlive reports whether ICMP_ALIVE_TYPES opted in to treating name as a reply
+func acceptsAlive(name string) bool {
+	return slices.Contains(cfg.ICMPAliveTypes, name)
+}
+
+// rawReplyType names the IPv4 replies that arrive as raw bodies but carry an echo's identifier
+// and sequence number in the same place; "" for any other type
+func rawReplyType(t icmp.Type) string {
+	switch t {
+	case ipv4.ICMPTypeTimestampReply:
+		return "timestamp-reply"
+	case ipv4.ICMPType(18): // address mask reply, obsolete and absent from x/net
+		return "address-mask-reply"
+	}
+	return ""
+}
+
+// newICMPError describes an error message of type t/code received from peer
+func newICMPError(t icmp.Type, code int, peer net.IP) *icmpError {
+	e := &icmpError{Code: code}
+	if peer != nil {
+		e.From = peer.String()
+	}
+	switch t {
+	case ipv4.ICMPTypeTimeExceeded, ipv6.ICMPTypeTimeExceeded:
+		e.Type, e.Reason = "time_exceeded", "ttl exceeded in transit"
+		if code == 1 {
+			e.Reason = "fragment reassembly time exceeded"
+		}
+		return e
+	case ipv6.ICMPTypeDestinationUnreachable:
+		e.Type, e.Reason = "unreachable", unreachReasons6[code]
+	default:
+		e.Type, e.Reason = "unreachable", unreachReasons4[code]
+	}
+	if e.Reason == "" {
+		e.Reason = "destination unreachable"
+	}
+	return e
+}
+
+// icmpListener owns one ICMP socket per family and routes echo replies to waiting probes
+type icmpListener struct {
+	conn     net.PacketConn
+	proto    int
+	echoType icmp.Type
+	dgram    bool             // unprivileged datagram socket: addressed by *net.UDPAddr, kernel owns the ID
+	p4       *ipv4.PacketConn // set when TTL control messages are enabled
+	p6       *ipv6.PacketConn // set when hop limit control messages are enabled
+	ttl      int              // outgoing TTL / hop limit set for ?maxttl=, 0 for the OS default
+
+	mu      sync.Mutex
+	waiters map[echoKey]chan echoReply
+}
+
+// startICMPListeners opens the shared v4/v6 ICMP sockets once at startup, bound to the
+// configured source addresses (SOURCE_IPV4/SOURCE_IPV6) or the wildcard
+func startICMPListeners() {
+	laddr4, laddr6 := "0.0.0.0", "::"
+	if src := cfg.sourceAddr("4"); src != nil {
+		laddr4 = src.String()
+	}
+	if src := cfg.sourceAddr("6"); src != nil {
+		laddr6 = src.String()
+	}
+	icmp4 = newICMPListener("4", laddr4)
+	icmp6 = newICMPListener("6", laddr6)
+}
+
+// icmpParams returns the unprivileged datagram and raw socket networks, protocol number and
+// echo request type for family
+func icmpParams(family string) (dgram, raw string, proto int, echoType icmp.Type) {
+	if family == "6" {
+		return "udp6", "ip6:ipv6-icmp", 58, ipv6.ICMPTypeEchoRequest
+	}
+	return "udp4", "ip4:icmp", 1, ipv4.ICMPTypeEcho
+}
+
+// stopICMPListeners closes the shared sockets, ending their read loops
+func stopICMPListeners() {
+	for _, l := range []*icmpListener{icmp4, icmp6} {
+		if l != nil {
+			_ = l.conn.Close()
+		}
+	}
+}
+
+func newICMPListener(family, laddr string) *icmpListener {
+	l, err := openICMPListener(family, laddr, 0)
+	if err != nil {
+		slog.Warn("icmp unavailable, falling back to tcp/system ping", "family", family, "err", err)
+		return nil
+	}
+	slog.Info("icmp socket open", "family", family, "unprivileged", l.dgram)
+	if l.p4 == nil && l.p6 == nil {
+		slog.Warn("icmp TTL control messages unavailable, replies won't report TTL", "family", family)
+	}
+	return l
+}
+
+// openICMPListener opens an ICMP socket for family on laddr and starts its read loop. It tries
+// an unprivileged datagram socket first (Linux with net.ipv4.ping_group_range covering our
+// group, macOS) and falls back to a raw socket, which needs CAP_NET_RAW or administrator rights.
+//
+// A ttl above 0 limits the echoes' TTL / hop limit. Such a socket prefers the raw kind, since
+// Linux datagram sockets don't deliver the Time Exceeded that tells "too far" from "no answer".
+func openICMPListener(family, laddr string, ttl int) (*icmpListener, error) {
+	dgramNet, rawNet, proto, echoType := icmpParams(family)
+	first, second := dgramNet, rawNet
+	if ttl > 0 {
+		first, second = rawNet, dgramNet
+	}
+	c, err := listenICMP(first, laddr)
+	if err != nil {
+		var err2 error
+		if c, err2 = listenICMP(second, laddr); err2 != nil {
+			return nil, errors.Join(err, err2)
+		}
+		first = second
+	}
+	l := &icmpListener{conn: c, proto: proto, echoType: echoType, dgram: first == dgramNet, ttl: ttl, waiters: make(map[echoKey]chan echoReply)}
+	if ttl > 0 {
+		if err := l.setTTL(ttl); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+	}
+	// Ask the kernel for the received TTL/hop limit so replies can report hop distance
+	if proto == 1 {
+		if p := ipv4Conn(c); p != nil && p.SetControlMessage(ipv4.FlagTTL, true) == nil {
+			l.p4 = p
+		}
+	} else if p := ipv6Conn(c); p != nil && p.SetControlMessage(ipv6.FlagHopLimit, true) == nil {
+		l.p6 = p
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+// setTTL sets the TTL / hop limit of the echoes l sends
+func (l *icmpListener) setTTL(ttl int) error {
+	if l.proto == 1 {
+		if p := ipv4Conn(l.conn); p != nil {
+			return p.SetTTL(ttl)
+		}
+	} else if p := ipv6Conn(l.conn); p != nil {
+		return p.SetHopLimit(ttl)
+	}
+	return errors.New("icmp: cannot set ttl on this socket")
+}
+
+// read receives one ICMP message along with its TTL/hop limit when available and the
+// address it came from
+func (l *icmpListener) read(buf []byte) (n, ttl int, peer net.Addr, err error) {
+	switch {
+	case l.p4 != nil:
+		var cm *ipv4.ControlMessage
+		n, cm, peer, err = l.p4.ReadFrom(buf)
+		if cm != nil {
+			ttl = cm.TTL
+		}
+	case l.p6 != nil:
+		var cm *ipv6.ControlMessage
+		n, cm, peer, err = l.p6.ReadFrom(buf)
+		if cm != nil {
+			ttl = cm.HopLimit
+		}
+	default:
+		n, peer, err = l.conn.ReadFrom(buf)
+	}
+	return n, ttl, peer, err
+}
+
+// readErrBackoff pauses the read loop after a failed read so a socket that keeps erroring
+// can't peg a CPU
+const readErrBackoff = 10 * time.Millisecond
+
+// readLoop demultiplexes incoming echo replies, and errors quoting our echoes, by ID/sequence.
+// It blocks in the socket read (no polling); closing the connection is what ends it.
+func (l *icmpListener) readLoop() {
+	buf := make([]byte, echoBufSize(echoPatternSize))
+	for {
+		n, ttl, peer, err := l.read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			time.Sleep(readErrBackoff)
+			continue
+		}
+		at := time.Now()
+		rm, err := icmp.ParseMessage(l.proto, buf[:n])
+		if err != nil {
+			continue
+		}
+		r := echoReply{at: at, ttl: ttl, from: peerIP(peer), trunc: n == len(buf)}
+		var id, seq int
+		ok := true
+		switch body := rm.Body.(type) {
+		case *icmp.Echo:
+			if rm.Type != ipv4.ICMPTypeEchoReply && rm.Type != ipv6.ICMPTypeEchoReply {
+				continue
+			}
+			id, seq = body.ID, body.Seq
+			// buf is reused by the next read
+			r.data = replyBufs.Get().(*[]byte)
+			*r.data = append((*r.data)[:0], body.Data...)
+		case *icmp.DstUnreach:
+			id, seq, ok = innerEcho(l.proto, body.Data)
+			r.err = newICMPError(rm.Type, rm.Code, r.from)
+		case *icmp.TimeExceeded:
+			id, seq, ok = innerEcho(l.proto, body.Data)
+			// Under ?maxttl= a time exceeded is the expected answer from beyond the limit
+			if l.ttl == 0 && acceptsAlive("time-exceeded") {
+				r.alive = "time-exceeded"
+			} else {
+				r.err = newICMPError(rm.Type, rm.Code, r.from)
+			}
+		case *icmp.RawBody:
+			name := rawReplyType(rm.Type)
+			if name == "" || !acceptsAlive(name) || len(body.Data) < 4 {
+				continue
+			}
+			id, seq = int(binary.BigEndian.Uint16(body.Data)), int(binary.BigEndian.Uint16(body.Data[2:]))
+			r.alive = name
+		default:
+			continue
+		}
+		if !ok {
+			continue
+		}
+		// Raw sockets see every echo reply on the host; only deliver our own
+		key := l.waiterKey(id, seq)
+		l.mu.Lock()
+		ch := l.waiters[key]
+		delete(l.waiters, key)
+		l.mu.Unlock()
+		if ch != nil {
+			ch <- r
+		} else if r.data != nil {
+			replyBufs.Put(r.data)
+		}
+	}
+}
+
+// waiterKey is the key an echo is registered under. Datagram sockets only ever receive replies
+// to their own requests, but the kernel replaces the ID with the socket's local port, so they
+// match on the sequence number alone.
+func (l *icmpListener) waiterKey(id, seq int) echoKey {
+	if l.dgram {
+		return echoKey{seq: seq}
+	}
+	return echoKey{id: id, seq: seq}
+}
+
+// errNoFreeSequence is returned by register when every one of the 65536 pairs is outstanding
+var errNoFreeSequence = errors.New("icmp: no free sequence")
+
+// register allocates an (ID, Seq) pair for a new echo and registers ch to receive its reply.
+// The 16-bit counter wraps after 65536 echoes, so a pair whose earlier echo is still
+// outstanding is skipped rather than letting one reply be handed to the wrong probe. Both are
+// derived from the counter, so one full turn of it tries every pair the socket can tell apart.
+func (l *icmpListener) register(ch chan echoReply) (id, seq int, key echoKey, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for range 1 << 16 {
+		id, seq = nextEcho()
+		key = l.waiterKey(id, seq)
+		if _, busy := l.waiters[key]; !busy {
+			l.waiters[key] = ch
+			return id, seq, key, nil
+		}
+		echoSeqSkips.Add(1)
+	}
+	return 0, 0, echoKey{}, errNoFreeSequence
+}
+
+// outstanding is the number of echoes awaiting a reply on l
+func (l *icmpListener) outstanding() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.waiters)
+}
+
+// addr converts dst into the address type the socket expects for WriteTo
+func (l *icmpListener) addr(dst *net.IPAddr) net.Addr {
+	if l.dgram {
+		return &net.UDPAddr{IP: dst.IP, Zone: dst.Zone}
+	}
+	return dst
+}
+
+// echo sends one echo request carrying payload (defaultEchoPayload when nil) to dst and waits
+// for the matching reply. The wait ends as soon as ctx is done, so a probe never outlives the
+// race that started it. An ICMP error quoting the request ends it early with ok false and
+// r.err set.
+func (l *icmpListener) echo(ctx context.Context, dst *net.IPAddr, payload []byte) (echoReply, bool) {
+	if payload == nil {
+		payload = defaultEchoPayload
+	}
+	ch := make(chan echoReply, 1)
+	id, seq, key, err := l.register(ch)
+	if err != nil {
+		slog.Warn("echo not sent", "dst", dst.String(), "error", err)
+		return echoReply{}, false
+	}
+	msg := icmp.Message{Type: l.echoType, Code: 0, Body: &icmp.Echo{ID: id, Seq: seq, Data: payload}}
+	defer func() {
+		l.mu.Lock()
+		delete(l.waiters, key)
+		l.mu.Unlock()
+	}()
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return echoReply{}, false
+	}
+
+	start := time.Now()
+	if _, err = l.conn.WriteTo(b, l.addr(dst)); err != nil {
+		return echoReply{}, false
+	}
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return r, false
+		}
+		r.rtt = r.at.Sub(start)
+		if r.alive != "" {
+			// Neither the sender (a router, for time exceeded) nor the data can be checked
+			return r, true
+		}
+		// ID and sequence matched, yet a different host answered: NAT, anycast or forgery
+		r.spoofed = r.from != nil && !r.from.Equal(dst.IP)
+		// Hosts must echo the data back verbatim; a change points at a middlebox rewriting it.
+		// A truncated reply was longer than anything we send, so it cannot be intact either.
+		r.mangled = r.trunc || !bytes.Equal(*r.data, payload)
+		replyBufs.Put(r.data)
+		r.data = nil
+		return r, true
+	case <-ctx.Done():
+		return echoReply{}, false
+	}
+}
+
+// echoRetry sends up to 1+ICMP_RETRIES echoes to dst, each with a fresh sequence number,
+// stopping at the first reply. Attempts back off: each gets double the previous one's share of
+// ctx's remaining time (1/3 then 2/3 with one retry). Returns the number of echoes sent.
+func (l *icmpListener) echoRetry(ctx context.Context, dst *net.IPAddr, payload []byte) (echoReply, int, bool) {
+	retries := cfg.ICMPRetries
+	deadline, hasDeadline := ctx.Deadline()
+	for a := 0; ; a++ {
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if hasDeadline && a < retries {
+			// Remaining attempts a..retries weigh 2^a..2^retries
+			share := time.Until(deadline) * (1 << a) / ((1 << (retries + 1)) - (1 << a))
+			actx, cancel = context.WithTimeout(ctx, share)
+		}
+		r, ok := l.echo(actx, dst, payload)
+		cancel()
+		// An explicit error won't change on a resend
+		if ok || r.err != nil || a >= retries || ctx.Err() != nil {
+			return r, a + 1, ok
+		}
+	}
+}
+
+// innerEcho extracts the echo ID/sequence of our original request quoted inside an ICMP
+// error message (original IP header followed by at least 8 bytes of the echo header). ok is
+// false when the quoted packet isn't an echo request.
+func innerEcho(proto int, data []byte) (id, seq int, ok bool) {
+	hdrLen := 40 // fixed IPv6 header; extension headers are not expected on our echoes
+	if proto == 1 {
+		if len(data) < 20 {
+			return 0, 0, false
+		}
+		hdrLen = int(data[0]&0x0f) << 2
+	}
+	if len(data) < hdrLen+8 {
+		return 0, 0, false
+	}
+	h := data[hdrLen:]
+	if (proto == 1 && h[0] != byte(ipv4.ICMPTypeEcho)) || (proto == 58 && h[0] != byte(ipv6.ICMPTypeEchoRequest)) {
+		return 0, 0, false
+	}
+	return int(h[4])<<8 | int(h[5]), int(h[6])<<8 | int(h[7]), true
+}
+
+// peerIP extracts the source IP from a ReadFrom address
+func peerIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// echoStats summarizes a run of echo requests to one address
+type echoStats struct {
+	Sent     int
+	Attempts int             // echo requests actually sent, including ICMP_RETRIES resends
+	RTTs     []time.Duration // one per reply, in send order
+	TTL      int             // TTL / hop limit of the first reply, 0 when unknown
+	Spoofed  bool            // some reply came from an address other than its destination
+	Mangled  bool            // some reply carried back a payload other than the one sent
+	AliveAs  string          // non-echo reply type accepted under ICMP_ALIVE_TYPES, "" when none was
+	Err      *icmpError      // last ICMP error received instead of a reply, nil if none
+}
+
+func (s echoStats) ok() bool { return len(s.RTTs) > 0 }
+
+// withinTTL tells, for echoes sent with a limited TTL, whether the target answered (true) or a
+// router reported the TTL expired on the way (false). nil when neither happened.
+func (s echoStats) withinTTL() *bool {
+	within := s.ok()
+	if !within && (s.Err == nil || s.Err.Type != "time_exceeded") {
+		return nil
+	}
+	return &within
+}
+
+// failure is the ICMP error that explains why no echo got a reply, nil if one did
+func (s echoStats) failure() *icmpError {
+	if s.ok() {
+		return nil
+	}
+	return s.Err
+}
+
+// firstRTT is the round trip of the first answered echo, 0 if none
+func (s echoStats) firstRTT() time.Duration {
+	if len(s.RTTs) == 0 {
+		return 0
+	}
+	return s.RTTs[0]
+}
+
+// lossPercent is the share of unanswered echoes, nil when nothing was sent
+func (s echoStats) lossPercent() *float64 {
+	if s.Sent == 0 {
+		return nil
+	}
+	loss := float64(s.Sent-len(s.RTTs)) * 100 / float64(s.Sent)
+	return &loss
+}
+
+// summary computes min/avg/max/jitter over the replies, nil without any
+func (s echoStats) summary() *rttStats {
+	if len(s.RTTs) == 0 {
+		return nil
+	}
+	lo, hi, sum := s.RTTs[0], s.RTTs[0], time.Duration(0)
+	var jitter time.Duration
+	for i, d := range s.RTTs {
+		lo, hi, sum = min(lo, d), max(hi, d), sum+d
+		if i > 0 {
+			diff := d - s.RTTs[i-1]
+			if diff < 0 {
+				diff = -diff
+			}
+			jitter += diff
+		}
+	}
+	st := &rttStats{
+		MinMs: rttMillis(lo),
+		AvgMs: rttMillis(sum / time.Duration(len(s.RTTs))),
+		MaxMs: rttMillis(hi),
+	}
+	if len(s.RTTs) > 1 {
+		st.JitterMs = float64((jitter/time.Duration(len(s.RTTs)-1)).Microseconds()/10) / 100
+	}
+	return st
+}
+
+// doICMP sends count sequential ICMP echo requests to dst (IPv6 zone honored) over l, each
+// with its own sequence number and the given payload (nil for the default), giving each an
+// equal share of the remaining deadline. Sends nothing if l is nil (ICMP sockets not permitted).
+func doICMP(ctx context.Context, l *icmpListener, dst *net.IPAddr, count int, payload []byte) echoStats {
+	var st echoStats
+	if l == nil {
+		return st
+	}
+	ctx, span := tracer.Start(ctx, "doICMP", trace.WithAttributes(
+		familyAttr(ipFamily(dst.IP)), attribute.String("target", dst.String()), attribute.Int("count", count)))
+	defer func() {
+		span.SetAttributes(attribute.Int("replies", len(st.RTTs)), attribute.Int("attempts", st.Attempts))
+		span.End()
+	}()
+	for i := 0; i < count && ctx.Err() == nil; i++ {
+		pctx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok && count > 1 {
+			pctx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(count-i))
+		}
+		st.Sent++
+		r, attempts, ok := l.echoRetry(pctx, dst, payload)
+		st.Attempts += attempts
+		if r.err != nil {
+			st.Err = r.err
+		}
+		if ok {
+			if len(st.RTTs) == 0 {
+				st.TTL = r.ttl
+			}
+			if r.spoofed {
+				st.Spoofed = true
+				slog.Warn("echo reply from unexpected source", "dst", dst.String(), "from", r.from.String())
+			}
+			if r.alive != "" && st.AliveAs == "" {
+				st.AliveAs = r.alive
+			}
+			if r.mangled {
+				st.Mangled = true
+				slog.Warn("echo reply payload altered", "dst", dst.String(), "from", r.from.String())
+			}
+			st.RTTs = append(st.RTTs, r.rtt)
+		}
+		cancel()
+	}
+	return st
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxIdempotencyKeyLen bounds the Idempotency-Key header, which is kept in memory
+const maxIdempotencyKeyLen = 255
+
+// Batch idempotency: a retried /api/ping/batch carrying the same Idempotency-Key and body is
+// answered with the stored results for IDEMPOTENCY_TTL instead of being probed again. The
+// cache is sized by setupSemaphores.
+var (
+	idempotencyCache *ttlCache[idempotentBatch]
+
+	idempotencyMu      sync.Mutex
+	idempotencyPending = map[string]*idempotentFlight{}
+)
+
+// errKeyReused is returned for an Idempotency-Key already used by a different batch
+var errKeyReused = errors.New("idempotency key was used for a different request")
+
+// idempotentBatch is a finished batch stored under its key
+type idempotentBatch struct {
+	fingerprint string
+	results     []batchResult
+}
+
+// idempotentFlight is a batch still being probed; duplicates wait on done
+type idempotentFlight struct {
+	fingerprint string
+	done        chan struct{}
+	results     []batchResult // set before done is closed; nil when the batch was not completed
+}
+
+// batchFingerprint identifies a batch by its targets and every option that shapes the results,
+// so a key reused for a different request is detected
+func batchFingerprint(targets []string, opts probeOptions) string {
+	h := sha256.New()
+	for _, t := range targets {
+		h.Write([]byte(opts.cacheKey(t)))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotentProbeAll is probeAll behind an idempotency key. A stored or in-flight batch with the
+// same key and fingerprint is returned (replayed=true) instead of probing again. Fails with
+// errKeyReused when the key belongs to a different request, or ctx's error when the caller
+// goes away while waiting for the first attempt.
+func idempotentProbeAll(ctx context.Context, key string, targets []string, opts probeOptions) (results []batchResult, replayed bool, err error) {
+	fp := batchFingerprint(targets, opts)
+	for {
+		if b, _, hit := idempotencyCache.get(key); hit {
+			if b.fingerprint != fp {
+				return nil, false, errKeyReused
+			}
+			return b.results, true, nil
+		}
+		idempotencyMu.Lock()
+		f := idempotencyPending[key]
+		if f == nil {
+			break // still holding idempotencyMu
+		}
+		idempotencyMu.Unlock()
+		if f.fingerprint != fp {
+			return nil, false, errKeyReused
+		}
+		select {
+		case <-f.done:
+			if f.results != nil {
+				return f.results, true, nil
+			}
+			// The first attempt was abandoned; run it here instead
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+	f := &idempotentFlight{fingerprint: fp, done: make(chan struct{})}
+	idempotencyPending[key] = f
+	idempotencyMu.Unlock()
+
+	results = probeAll(ctx, targets, opts)
+	// A batch cut short by its client holds partial results that a retry must not be served
+	if ctx.Err() == nil {
+		f.results = results
+		idempotencyCache.set(key, idempotentBatch{fingerprint: fp, results: results}, time.Duration(cfg.IdempotencyTTL))
+	}
+	idempotencyMu.Lock()
+	delete(idempotencyPending, key)
+	idempotencyMu.Unlock()
+	close(f.done)
+	return results, false, nil
+}
+
+// idempotencyKey returns the request's Idempotency-Key scoped to its principal, so clients
+// can't replay or block each other's batches by guessing keys; "" when the header is absent.
+// Answers 400 itself when the key is too long.
+func idempotencyKey(c *gin.Context) (string, bool) {
+	key := strings.TrimSpace(c.GetHeader("Idempotency-Key"))
+	if len(key) > maxIdempotencyKeyLen {
+		abortWithError(c, 400, "Idempotency-Key too long")
+		return "", false
+	}
+	if key == "" {
+		return "", true
+	}
+	return principal(c) + "\x00" + key, true
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// semRequests caps concurrently served probe requests (MAX_INFLIGHT_REQUESTS); nil when unlimited
+var semRequests *semaphore
+
+// cheapRoutes answer from memory or a single syscall and are never held back by the request cap
+var cheapRoutes = map[string]bool{
+	"/api/stats":    true,
+	"/api/validate": true,
+	"/api/myip":     true,
+}
+
+// inflightMiddleware admits at most limit probe requests at once. An excess request waits up to
+// queueWait for a slot and is then refused with 503 and a Retry-After hint, so a burst of
+// checks is shed instead of piling up goroutines and sockets. Returns nil when limit is 0.
+func inflightMiddleware(limit int, queueWait time.Duration) gin.HandlerFunc {
+	if limit <= 0 {
+		return nil
+	}
+	semRequests = newSemaphore(limit)
+	retryAfter := strconv.Itoa(int(math.Ceil(max(queueWait, time.Second).Seconds())))
+	return func(c *gin.Context) {
+		if cheapRoutes[c.FullPath()] {
+			c.Next()
+			return
+		}
+		ctx, cancel := c.Request.Context(), context.CancelFunc(func() {})
+		if queueWait > 0 {
+			ctx, cancel = context.WithTimeout(ctx, queueWait)
+		}
+		if !tryAcquire(ctx, semRequests, queueWait > 0) {
+			cancel()
+			c.Header("Retry-After", retryAfter)
+			abortWithError(c, 503, "too many requests in flight")
+			return
+		}
+		cancel()
+		defer release(semRequests)
+		c.Next()
+	}
+}
+
+// tryAcquire takes a slot of sem, waiting on ctx only when wait is set
+func tryAcquire(ctx context.Context, sem *semaphore, wait bool) bool {
+	if wait {
+		return acquire(ctx, sem)
+	}
+	select {
+	case sem.slots <- struct{}{}:
+		sem.inflight.Add(1)
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultListenAddr is used when neither -listen nor LISTEN_ADDR is set
+const defaultListenAddr = ":5601"
+
+// parseListenAddr validates a bind address: host:port (host may be empty, an IP or a hostname)
+// or "unix:/path/to.sock". It returns the network and address for net.Listen.
+func parseListenAddr(s string) (network, addr string, err error) {
+	if path, ok := strings.CutPrefix(s, "unix:"); ok {
+		if path == "" {
+			return "", "", errors.New("unix socket path is empty")
+		}
+		return "unix", path, nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", "", err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", "", fmt.Errorf("invalid port %q", port)
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		if _, ok := normalizeDomain(host); !ok {
+			return "", "", fmt.Errorf("invalid host %q", host)
+		}
+	}
+	return "tcp", s, nil
+}
+
+// listen binds the server socket. A stale Unix socket left behind by a crashed instance is
+// removed first; regular files are never touched.
+func listen(network, addr string) (net.Listener, error) {
+	if network == "unix" {
+		if fi, err := os.Lstat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if _, err := net.Dial("unix", addr); err != nil {
+				os.Remove(addr)
+			}
+		}
+	}
+	return net.Listen(network, addr)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupLogging installs a JSON slog handler on stdout at LOG_LEVEL (debug|info|warn|error)
+func setupLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(os.Getenv("LOG_LEVEL")))); err != nil {
+		level = slog.LevelInfo
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
+}
+
+// fatal logs at error level and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// reRequestID limits client-supplied request IDs to something safe to echo and log
+var reRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// newRequestID returns 16 random hex characters
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logProbe attaches the probed input and result to the request's log line
+func logProbe(c *gin.Context, input string, res pingResult) {
+	c.Set("log.input", input)
+	c.Set("log.result", res)
+}
+
+// requestLogger assigns each request an ID (echoed in X-Request-ID) and emits one structured
+// log line when it completes
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader("X-Request-ID")
+		if !reRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		c.Set("request_id", id)
+		c.Header("X-Request-ID", id)
+
+		c.Next()
+		requestsServed.Add(1)
+
+		attrs := []any{
+			"request_id", id,
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"client_ip", clientIP(c),
+			"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if errors.Is(c.Request.Context().Err(), context.Canceled) {
+			// The client went away mid-request; its probes were cancelled with it
+			attrs = append(attrs, "aborted", true)
+		}
+		if v, ok := c.Get("log.input"); ok {
+			attrs = append(attrs, "input", v)
+		}
+		if v, ok := c.Get("log.result"); ok {
+			res := v.(pingResult)
+			attrs = append(attrs, "ipv4", res.IPv4, "ipv6", res.IPv6, "ipv4_method", res.IPv4Method, "ipv6_method", res.IPv6Method)
+		}
+		level := slog.LevelInfo
+		if p := c.Request.URL.Path; p == "/healthz" || p == "/readyz" {
+			level = slog.LevelDebug // keep probe noise out of info logs
+		}
+		slog.Log(c.Request.Context(), level, "request", attrs...)
+	}
+}
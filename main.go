@@ -2,401 +2,1542 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
-	"log"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/net/icmp"
+	"github.com/gin-gonic/gin/binding"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/idna"
-	"golang.org/x/net/ipv4"
-	"golang.org/x/net/ipv6"
 )
 
 // apiResponse is the JSON response structure for /api/ping/json
 type apiResponse struct {
-	Code int         `json:"code"`
-	Msg  string      `json:"msg"`
-	Data interface{} `json:"data,omitempty"`
+	Code    int           `json:"code"`
+	Msg     string        `json:"msg"`
+	Data    interface{}   `json:"data,omitempty"`
+	Summary *batchSummary `json:"summary,omitempty"`
 }
 
+// Status is the outcome of probing one family. The values are a stable contract for clients;
+// the text endpoint keeps its older ok/no wording (see legacyStatus).
+type Status string
+
+const (
+	StatusReachable     Status = "reachable"
+	StatusUnreachable   Status = "unreachable"    // probed, and nothing answered
+	StatusTimeout       Status = "timeout"        // the deadline cut probing short
+	StatusDNSError      Status = "dns_error"      // the lookup for this family failed
+	StatusNotApplicable Status = "not_applicable" // excluded by ?family=, or no address of this family
+	StatusError         Status = "error"          // probing failed unexpectedly (a recovered panic); see error
+)
+
 // pingResult holds IPv4/IPv6 results
 type pingResult struct {
-	IPv4 string `json:"ipv4"`
-	IPv6 string `json:"ipv6"`
+	IPv4      Status   `json:"ipv4"`
+	IPv6      Status   `json:"ipv6"`
+	IPv4Addrs []string `json:"ipv4_addrs,omitempty"` // addresses probed, at most MAX_PROBE_IPS per family
+	IPv6Addrs []string `json:"ipv6_addrs,omitempty"`
+	IPv4RTTms float64  `json:"ipv4_rtt_ms"` // ICMP echo round trip, -1 when no echo reply
+	IPv6RTTms float64  `json:"ipv6_rtt_ms"`
+	Resolved  bool     `json:"resolved"`        // false when a domain produced no A/AAAA records
+	Error     string   `json:"error,omitempty"` // resolution failure reason
+	TimedOut  bool     `json:"timedout,omitempty"`
+
+	IPv4Resolved int `json:"ipv4_resolved,omitempty"` // addresses a domain resolved to, before MAX_PROBE_IPS
+	IPv6Resolved int `json:"ipv6_resolved,omitempty"`
+	IPv4Probed   int `json:"ipv4_probed,omitempty"` // addresses actually probed
+	IPv6Probed   int `json:"ipv6_probed,omitempty"`
+
+	IPv4PTR map[string][]string `json:"ipv4_ptr,omitempty"` // address -> PTR names (ptr=1)
+	IPv6PTR map[string][]string `json:"ipv6_ptr,omitempty"`
+
+	IPv4Geo map[string]geoInfo `json:"ipv4_geo,omitempty"` // address -> country/ASN (GEOIP_DB)
+	IPv6Geo map[string]geoInfo `json:"ipv6_geo,omitempty"`
+
+	IPv4Loss *float64 `json:"ipv4_loss,omitempty"` // echo loss percentage, present when echoes were sent
+	IPv6Loss *float64 `json:"ipv6_loss,omitempty"`
+
+	Stats *pingStats `json:"stats,omitempty"` // RTT summary when count>1
+
+	IPv4TTL int    `json:"ipv4_ttl,omitempty"` // TTL / hop limit seen on the echo reply
+	IPv6TTL int    `json:"ipv6_ttl,omitempty"`
+	TTLNote string `json:"ttl_note,omitempty"` // why a TTL is missing despite an echo reply
+
+	IPv4Attempts int `json:"ipv4_attempts,omitempty"` // echoes sent including retries (ICMP_RETRIES > 0)
+	IPv6Attempts int `json:"ipv6_attempts,omitempty"`
+
+	IPv4Method string `json:"ipv4_method,omitempty"` // "icmp", "tcp:<port>", "udp:<port>" or "system-ping"
+	IPv6Method string `json:"ipv6_method,omitempty"`
+
+	IPv4ReplyType string `json:"ipv4_reply_type,omitempty"` // non-echo ICMP reply that proved the host up (ICMP_ALIVE_TYPES)
+	IPv6ReplyType string `json:"ipv6_reply_type,omitempty"`
+
+	IPv4WithinMaxTTL *bool `json:"ipv4_within_maxttl,omitempty"` // ?maxttl=: echo reply (true) or time exceeded (false)
+	IPv6WithinMaxTTL *bool `json:"ipv6_within_maxttl,omitempty"`
+
+	SpoofedSource bool `json:"spoofed_source,omitempty"` // an echo reply came from an address other than the one probed
+
+	PayloadIntact *bool `json:"payload_intact,omitempty"` // ?pattern= echo replies all carried the pattern back unchanged
+
+	NoLocalIPv6 bool `json:"no_local_ipv6,omitempty"` // IPv6 addresses were not probed: this host has no IPv6
+
+	ICMPError *icmpErrors `json:"icmp_error,omitempty"` // unreachable/time exceeded received instead of echo replies
+
+	TLS *tlsReport `json:"tls,omitempty"` // certificate on port 443 (tls=1)
+
+	CNAMEChain    []string `json:"cname_chain,omitempty"`    // queried name then its canonical name (cname=1)
+	DanglingCNAME bool     `json:"dangling_cname,omitempty"` // CNAME resolved but its target has no A/AAAA
+
+	Timings *timings `json:"timings,omitempty"` // wall-clock time spent per phase
+
+	family string // the ?family= restriction, for the legacy wording of excluded families
+}
+
+// reachable reports whether either family was reachable
+func (r *pingResult) reachable() bool {
+	return r.IPv4 == StatusReachable || r.IPv6 == StatusReachable
+}
+
+// legacyStatus words a family's status the way the text endpoint always has: "ok", "timeout",
+// "skipped" for a family ?family= excluded, "no" for everything else
+func (r *pingResult) legacyStatus(family string) string {
+	s := r.IPv4
+	if family == "6" {
+		s = r.IPv6
+	}
+	switch {
+	case s == StatusReachable:
+		return "ok"
+	case s == StatusTimeout:
+		return "timeout"
+	case r.family != "" && r.family != family:
+		return "skipped"
+	}
+	return "no"
+}
+
+// timings breaks a request's latency down by phase. Families probe concurrently, so each probe
+// phase reports the longer of the two; phases that never ran are omitted.
+type timings struct {
+	DNSms   *float64 `json:"dns_ms,omitempty"`
+	ICMPms  *float64 `json:"icmp_ms,omitempty"`
+	TCPms   *float64 `json:"tcp_ms,omitempty"`
+	UDPms   *float64 `json:"udp_ms,omitempty"`
+	PingMs  *float64 `json:"ping_ms,omitempty"` // system ping fallback
+	TotalMs float64  `json:"total_ms"`
+}
+
+// addPhases merges one family's per-method durations, keeping the longest per phase
+func (t *timings) addPhases(phases map[string]time.Duration) {
+	for m, d := range phases {
+		var f **float64
+		switch m {
+		case "icmp":
+			f = &t.ICMPms
+		case "tcp":
+			f = &t.TCPms
+		case "udp":
+			f = &t.UDPms
+		case "ping":
+			f = &t.PingMs
+		default:
+			continue
+		}
+		if ms := rttMillis(d); *f == nil || ms > **f {
+			*f = &ms
+		}
+	}
+}
+
+// pingStats holds the classic ping summary per family
+type pingStats struct {
+	IPv4 *rttStats `json:"ipv4,omitempty"`
+	IPv6 *rttStats `json:"ipv6,omitempty"`
+}
+
+// icmpErrors holds the ICMP error each family's echoes drew instead of a reply
+type icmpErrors struct {
+	IPv4 *icmpError `json:"ipv4,omitempty"`
+	IPv6 *icmpError `json:"ipv6,omitempty"`
+}
+
+// rttStats is min/avg/max RTT plus jitter (mean absolute difference of successive samples)
+type rttStats struct {
+	MinMs    float64 `json:"min_ms"`
+	AvgMs    float64 `json:"avg_ms"`
+	MaxMs    float64 `json:"max_ms"`
+	JitterMs float64 `json:"jitter_ms"`
+}
+
+// setOutcome fills per-family status, winning method and echo measurements
+func (r *pingResult) setOutcome(o4, o6 familyOutcome) {
+	if o4.method != "" {
+		r.IPv4 = StatusReachable
+	} else if o4.timedOut {
+		r.IPv4 = StatusTimeout
+	}
+	if o6.method != "" {
+		r.IPv6 = StatusReachable
+	} else if o6.timedOut {
+		r.IPv6 = StatusTimeout
+	}
+	r.TimedOut = o4.timedOut || o6.timedOut
+	r.IPv4Method, r.IPv6Method = o4.method, o6.method
+	r.setEcho(o4.echo, o6.echo)
+}
+
+// httpStatus is 504 when the deadline left a family inconclusive, 200 otherwise
+func (r *pingResult) httpStatus() int {
+	if r.TimedOut {
+		return 504
+	}
+	return 200
+}
+
+// setEcho copies per-family echo measurements into the result
+func (r *pingResult) setEcho(v4, v6 echoStats) {
+	r.IPv4RTTms, r.IPv6RTTms = rttMillis(v4.firstRTT()), rttMillis(v6.firstRTT())
+	r.IPv4Loss, r.IPv6Loss = v4.lossPercent(), v6.lossPercent()
+	r.IPv4TTL, r.IPv6TTL = v4.TTL, v6.TTL
+	r.SpoofedSource = v4.Spoofed || v6.Spoofed
+	r.IPv4ReplyType, r.IPv6ReplyType = v4.AliveAs, v6.AliveAs
+	if e4, e6 := v4.failure(), v6.failure(); e4 != nil || e6 != nil {
+		r.ICMPError = &icmpErrors{IPv4: e4, IPv6: e6}
+	}
+	if cfg.ICMPRetries > 0 {
+		r.IPv4Attempts, r.IPv6Attempts = v4.Attempts, v6.Attempts
+	}
+	if (v4.ok() && v4.TTL == 0) || (v6.ok() && v6.TTL == 0) {
+		r.TTLNote = "ttl unavailable: control messages not enabled on the icmp socket"
+	}
+	if v4.Sent > 1 || v6.Sent > 1 {
+		if s := (pingStats{IPv4: v4.summary(), IPv6: v6.summary()}); s.IPv4 != nil || s.IPv6 != nil {
+			r.Stats = &s
+		}
+	}
 }
 
-// Global semaphores to cap concurrent operations (configurable via env)
+// Global semaphores to cap concurrent operations (sized from the config)
 var (
-	semDNS  chan struct{}
-	semICMP chan struct{}
-	semTCP  chan struct{}
+	semDNS  *semaphore
+	semICMP *semaphore
+	semTCP  *semaphore
+	semUDP  *semaphore
 )
 
 func init() {
-	semDNS = make(chan struct{}, getEnvInt("MAX_DNS", 4096))
-	semICMP = make(chan struct{}, getEnvInt("MAX_ICMP", 8192))
-	semTCP = make(chan struct{}, getEnvInt("MAX_TCP", 8192))
+	setupLogging()
+}
+
+// setupSemaphores sizes the global semaphores, the worker pool and the caches from c
+func setupSemaphores(c Config) {
+	semDNS = newSemaphore(c.MaxDNS)
+	semICMP = newSemaphore(c.MaxICMP)
+	semTCP = newSemaphore(c.MaxTCP)
+	semUDP = newSemaphore(c.MaxUDP)
+	probePool = newWorkerPool(c.MaxWorkers)
+	resultCache = newTTLCache[pingResult](c.CacheMaxEntries)
+	idempotencyCache = newTTLCache[idempotentBatch](c.IdempotencyMaxKeys)
+}
+
+// envError is an env var the getEnv helpers could not use and replaced by its default
+type envError struct{ key, value, want string }
+
+func (e envError) Error() string {
+	return fmt.Sprintf("invalid %s: %q (want %s)", e.key, e.value, e.want)
+}
+
+// envErrors collects the unusable env vars. Some are read while package variables initialize,
+// before logging is set up, so they are reported later by applyEnv (fatal with STRICT_CONFIG).
+var envErrors []error
+
+// badEnv records that key holds an unusable value
+func badEnv(key, value, want string) {
+	envErrors = append(envErrors, envError{key, value, want})
 }
 
+// getEnvInt reads a positive integer; unset keeps def, anything unusable (0 included) is
+// reported and keeps def too
 func getEnvInt(key string, def int) int {
+	return getEnvNumber(key, def, strconv.Atoi, "a positive integer", false)
+}
+
+// getEnvIntZero is getEnvInt for settings where 0 means off or unlimited, so that an explicit 0
+// overrides the config file
+func getEnvIntZero(key string, def int) int {
+	return getEnvNumber(key, def, strconv.Atoi, "0 or a positive integer", true)
+}
+
+// getEnvFloat is getEnvInt for positive numbers
+func getEnvFloat(key string, def float64) float64 {
+	return getEnvNumber(key, def, parseFloat, "a positive number", false)
+}
+
+// getEnvFloatZero is getEnvIntZero for numbers
+func getEnvFloatZero(key string, def float64) float64 {
+	return getEnvNumber(key, def, parseFloat, "0 or a positive number", true)
+}
+
+// getEnvDuration is getEnvInt for positive Go durations ("5s")
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	return getEnvNumber(key, def, time.ParseDuration, "a positive duration such as 5s", false)
+}
+
+// getEnvDurationZero is getEnvIntZero for Go durations
+func getEnvDurationZero(key string, def time.Duration) time.Duration {
+	return getEnvNumber(key, def, time.ParseDuration, "0 or a positive duration such as 5s", true)
+}
+
+func parseFloat(s string) (float64, error) { return strconv.ParseFloat(s, 64) }
+
+// getEnvNumber parses key with parse, keeping def when it is unset and reporting it when it is
+// malformed, negative, or 0 without zero
+func getEnvNumber[T int | float64 | time.Duration](key string, def T, parse func(string) (T, error), want string, zero bool) T {
 	v := strings.TrimSpace(os.Getenv(key))
 	if v == "" {
 		return def
 	}
-	i, err := strconv.Atoi(v)
-	if err != nil || i <= 0 {
+	n, err := parse(v)
+	if err != nil || n < 0 || n == 0 && !zero {
+		badEnv(key, v, want)
 		return def
 	}
-	return i
+	return n
 }
 
-func acquire(ctx context.Context, sem chan struct{}) bool {
-	select {
-	case sem <- struct{}{}:
+// getEnvBool reads 1/true or 0/false (any case); unset keeps def. Other values are reported and,
+// as they always have, read as false.
+func getEnvBool(key string, def bool) bool {
+	v := strings.TrimSpace(os.Getenv(key))
+	switch {
+	case v == "":
+		return def
+	case v == "1" || strings.EqualFold(v, "true"):
 		return true
-	case <-ctx.Done():
-		return false
+	case v != "0" && !strings.EqualFold(v, "false"):
+		badEnv(key, v, "1, true, 0 or false")
 	}
+	return false
 }
 
-func release(sem chan struct{}) { <-sem }
+// getEnvList splits a comma-separated env value, dropping empty items
+func getEnvList(key string) []string {
+	var out []string
+	for _, s := range strings.Split(os.Getenv(key), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
 
 func main() {
+	flag.Parse()
+	c, err := loadConfig(*configFlag)
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+	cfg = c
+	setupSemaphores(cfg)
+	if err := setupSOCKS5(cfg.SOCKS5Proxy); err != nil {
+		fatal("invalid SOCKS5_PROXY", "err", err)
+	}
+	shutdownTracing := setupTracing(context.Background())
+
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
-	r.Use(gin.Recovery())
-	// Security headers (CSP allows inline style/script for this single-page app)
-	r.Use(func(c *gin.Context) {
-		h := c.Writer.Header()
-		h.Set("X-Frame-Options", "DENY")
-		h.Set("X-Content-Type-Options", "nosniff")
-		// Allow inline style/script and same-origin fetch/img
-		h.Set("Content-Security-Policy", "default-src 'self'; style-src 'self' 'unsafe-inline'; script-src 'self' 'unsafe-inline'; img-src 'self' data:; connect-src 'self'")
-		c.Next()
-	})
+	// Only honor X-Forwarded-For from proxies listed in TRUSTED_PROXIES (none by default)
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		fatal("invalid TRUSTED_PROXIES", "err", err)
+	}
+	r.Use(gin.CustomRecovery(handlePanic))
+	r.NoRoute(handleNotFound)
+	// Traced requests (OTEL_EXPORTER_OTLP_ENDPOINT set) get a server span around everything else
+	if mw := tracingMiddleware(); mw != nil {
+		r.Use(mw)
+	}
+	r.Use(requestLogger())
+	if cfg.AccessLog != "" {
+		w, err := openAccessLog(cfg.AccessLogFile)
+		if err != nil {
+			fatal("cannot open ACCESS_LOG_FILE", "path", cfg.AccessLogFile, "err", err)
+		}
+		r.Use(accessLogMiddleware(w))
+	}
+	r.Use(bodyLimitMiddleware(cfg.MaxBodyBytes))
+	// Inside the loggers, so they record the bytes actually sent
+	if !cfg.DisableGzip {
+		r.Use(gzipMiddleware(cfg.GzipMinBytes))
+	}
+	// Registered on the engine so preflights for routes without an OPTIONS handler still see it
+	if mw := corsMiddleware(cfg.CORSOrigins); mw != nil {
+		r.Use(mw)
+	}
+	// Security headers (the default CSP allows inline style/script for the bundled page)
+	r.Use(securityHeadersMiddleware(cfg.CSPPolicy, cfg.FrameOptions))
+
+	// API-only deployments behind another frontend can drop the page (SERVE_INDEX=0)
+	if *cfg.ServeIndex {
+		r.GET("/", func(c *gin.Context) { c.File("index.html") })
+	}
+	// Health checks stay outside /api so they're never rate limited
+	r.GET("/healthz", handleHealthz)
+	r.GET("/readyz", handleReadyz)
 
-	r.GET("/", func(c *gin.Context) { c.File("index.html") })
+	rateLimit := rateLimitMiddleware(cfg.RateLimitRPS, cfg.RateLimitBurst, cfg.RateLimitMaxClients)
+	// validated at startup
+	basicUsers, _ := parseBasicUsers(cfg.BasicAuthUsers)
+	apiKey := apiKeyMiddleware(cfg.APIKeys, basicUsers)
+	api := r.Group("/api")
+	if rateLimit != nil {
+		api.Use(rateLimit)
+	}
+	// Rate-limited clients are turned away before they can take one of the request slots
+	inflight := inflightMiddleware(cfg.MaxInflightRequests, time.Duration(cfg.InflightQueueWait))
+	if inflight != nil {
+		api.Use(inflight)
+	}
+	// Requests stuck behind saturated probe semaphores are shed rather than left to queue
+	backpressure := backpressureMiddleware(time.Duration(cfg.AcquireTimeout))
+	if backpressure != nil {
+		api.Use(backpressure)
+	}
+	// Expensive endpoints require an API key or Basic credentials when API_KEYS or
+	// BASIC_AUTH_USERS is set; ping only with api_auth_ping
+	secured := api.Group("")
+	if apiKey != nil {
+		secured.Use(apiKey)
+	}
+	pingGroup := api
+	if cfg.APIAuthPing {
+		pingGroup = secured
+	}
 
-	r.GET("/api/ping", func(c *gin.Context) {
-		input := strings.TrimSpace(c.Query("ip"))
+	// GET or POST; a POST body's ip (form or JSON) takes precedence over the query
+	pingMethods := []string{http.MethodGet, http.MethodPost}
+	// The Accept header picks plain text (default), JSON or CSV
+	pingGroup.Match(pingMethods, "/ping", func(c *gin.Context) {
+		format := pingFormat(c)
+		input := pingInput(c)
 		if !isValidInput(input) {
-			c.String(400, "invalid ip or domain")
+			abortWithError(c, 400, "invalid ip or domain")
 			return
 		}
-		res := detectAndPing(c.Request.Context(), input)
-		c.Header("Content-Type", "text/plain; charset=utf-8")
-		c.String(200, "ipv4:%s,ipv6:%s", res.IPv4, res.IPv6)
+		opts, err := parseProbeOptions(c)
+		if err == nil {
+			err = opts.checkTarget(input)
+		}
+		if err != nil {
+			abortWithError(c, 400, err.Error())
+			return
+		}
+		res, cs := cachedDetectAndPing(c.Request.Context(), input, opts)
+		logProbe(c, input, res)
+		if setCacheHeaders(c, cs, format, input, res) {
+			return
+		}
+		writePing(c, format, input, res)
 	})
 
-	r.GET("/api/ping/json", func(c *gin.Context) {
-		input := strings.TrimSpace(c.Query("ip"))
+	pingGroup.Match(pingMethods, "/ping/json", func(c *gin.Context) {
+		input := pingInput(c)
+		// ?ip=a,b,c answers with an array; a single target keeps the object shape
+		if strings.Contains(input, ",") {
+			handlePingList(c, input)
+			return
+		}
 		if !isValidInput(input) {
-			c.JSON(400, apiResponse{Code: 400, Msg: "invalid ip or domain"})
+			abortWithError(c, 400, "invalid ip or domain")
+			return
+		}
+		opts, err := parseProbeOptions(c)
+		if err == nil {
+			err = opts.checkTarget(input)
+		}
+		if err != nil {
+			abortWithError(c, 400, err.Error())
+			return
+		}
+		res, cs := cachedDetectAndPing(c.Request.Context(), input, opts)
+		logProbe(c, input, res)
+		if setCacheHeaders(c, cs, gin.MIMEJSON, input, res) {
 			return
 		}
-		res := detectAndPing(c.Request.Context(), input)
-		c.JSON(200, apiResponse{Code: 200, Msg: "success", Data: res})
+		writePingJSON(c, res)
 	})
 
-	addr := ":5601"
-	log.Printf("server listening on %s", addr)
+	pingGroup.GET("/ping/ndjson", handlePingNDJSON)
+	secured.POST("/ping/batch", handleBatch)
+	secured.POST("/ping/ndjson", handleBatchNDJSON)
+	api.GET("/traceroute", handleTraceroute)
+	api.GET("/mtr", handleMTR)
+	secured.GET("/scan", handleScan)
+	secured.GET("/portscan", handlePortScan)
+	api.GET("/http", handleHTTPCheck)
+	api.GET("/dns", handleDNSLookup)
+	api.GET("/tcp", handleTCPCheck)
+	api.GET("/stats", handleStats)
+	api.GET("/myip", handleMyIP)
+	api.GET("/validate", handleValidate)
+
+	// The monitor socket shares the API's rate limiter and is authenticated like ping. An open
+	// socket holds its request slot for as long as it lives, and its probes are shed like any
+	// other request's.
+	ws := r.Group("/ws")
+	if rateLimit != nil {
+		ws.Use(rateLimit)
+	}
+	if inflight != nil {
+		ws.Use(inflight)
+	}
+	if backpressure != nil {
+		ws.Use(backpressure)
+	}
+	if apiKey != nil && cfg.APIAuthPing {
+		ws.Use(apiKey)
+	}
+	ws.GET("/monitor", handleMonitor)
+
+	setupResolver(cfg)
+	setupHostsFile(cfg.HostsFile)
+	setupGeoIP(cfg.GeoIPDB)
+	setupPing()
+	setupIPv6()
+	setupVRF()
+	startICMPListeners()
+	if *selftestFlag {
+		code := runSelftest(os.Stdout, strings.TrimSpace(*selftestHost))
+		stopICMPListeners()
+		os.Exit(code)
+	}
+	if cfg.EnablePprof {
+		startPprof(cfg.PprofAddr)
+	}
+
+	addr := cfg.ListenAddr
+	network, bindAddr, _ := parseListenAddr(addr) // validated by loadConfig
+	ln, err := listen(network, bindAddr)
+	if err != nil {
+		fatal("listen failed", "addr", addr, "err", err)
+	}
+	slog.Info("server listening", "addr", ln.Addr().String(), "network", network, "tls", cfg.TLSCert != "")
 	// Custom server with timeouts to prevent slowloris
 	srv := &http.Server{
-		Addr:              addr,
 		Handler:           r,
 		ReadHeaderTimeout: 2 * time.Second,
 		ReadTimeout:       5 * time.Second,
-		WriteTimeout:      7 * time.Second,
+		WriteTimeout:      maxProbeTimeout + 2*time.Second,
 		IdleTimeout:       30 * time.Second,
 	}
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatal(err)
+	if cfg.EnableH2C {
+		// Plaintext HTTP/2 for clients and proxies that speak it with prior knowledge, next to
+		// HTTP/1.1 on the same port; net/http has this built in, replacing x/net's h2c wrapper
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetHTTP2(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	// Request contexts derive from rootCtx so in-flight probes can be cancelled on shutdown
+	rootCtx, cancelRoot := context.WithCancel(context.Background())
+	defer cancelRoot()
+	srv.BaseContext = func(net.Listener) context.Context { return rootCtx }
+	if cfg.TLSCert != "" {
+		certs, err := newCertReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			fatal("invalid TLS certificate", "cert", cfg.TLSCert, "key", cfg.TLSKey, "err", err)
+		}
+		// Certificates come from the callback, so SIGHUP can swap them under live connections
+		srv.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate, MinVersion: tls.VersionTLS12}
+		go certs.watch(rootCtx)
+	}
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errCh := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errCh <- srv.ServeTLS(ln, "", "")
+			return
+		}
+		errCh <- srv.Serve(ln)
+	}()
+	select {
+	case err := <-errCh:
+		if err != nil && err != http.ErrServerClosed {
+			fatal("server failed", "err", err)
+		}
+		return
+	case <-sigCtx.Done():
+	}
+
+	grace := time.Duration(cfg.ShutdownGrace)
+	slog.Info("shutting down", "grace", grace.String())
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("graceful shutdown incomplete", "err", err)
+	}
+	// Stop whatever is still probing, then release the shared sockets
+	cancelRoot()
+	stopICMPListeners()
+	tctx, tcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer tcancel()
+	shutdownTracing(tctx)
+}
+
+// pingInput returns the ping target: the "ip" field of a POST form or JSON body when present,
+// otherwise the ip query parameter
+func pingInput(c *gin.Context) string {
+	if c.Request.Method == http.MethodPost {
+		switch c.ContentType() {
+		case binding.MIMEJSON:
+			var body struct {
+				IP string `json:"ip"`
+			}
+			if c.ShouldBindJSON(&body) == nil && strings.TrimSpace(body.IP) != "" {
+				return strings.TrimSpace(body.IP)
+			}
+		case binding.MIMEPOSTForm:
+			if v := strings.TrimSpace(c.PostForm("ip")); v != "" {
+				return v
+			}
+		}
 	}
+	return strings.TrimSpace(c.Query("ip"))
 }
 
 // isValidInput validates IPv4/IPv6/Domain and normalizes domain using IDNA
 func isValidInput(s string) bool {
-	if s == "" || len(s) > 255 {
-		return false
+	return checkInput(s).Valid
+}
+
+// simple domain regex, applied after IDNA conversion. Underscores are allowed anywhere in a
+// label for service and policy names such as _dmarc.example.com or _sip._tcp.example.com.
+var reDomain = regexp.MustCompile(`^(?i:[a-z0-9_](?:[a-z0-9_-]{0,61}[a-z0-9_])?(?:\.[a-z0-9_](?:[a-z0-9_-]{0,61}[a-z0-9_])?)*)$`)
+
+// idnaProfile is idna.Lookup without the STD3 hostname rules, which would reject underscores;
+// reDomain enforces the allowed characters instead
+var idnaProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+
+// normalizeDomain converts a domain to its IDNA ASCII (punycode) form and validates it:
+// only letters/digits/hyphen/underscore/dot are allowed after conversion. A single trailing
+// dot (fully-qualified name) is accepted and dropped from the result.
+func normalizeDomain(s string) (string, bool) {
+	ascii, err := idnaProfile.ToASCII(strings.TrimSuffix(s, "."))
+	if err != nil || ascii == "" || len(ascii) > 253 || !reDomain.MatchString(ascii) {
+		return "", false
 	}
-	if ip := net.ParseIP(s); ip != nil {
-		return true
+	return ascii, true
+}
+
+// maxPorts caps how many TCP ports a single request may probe
+const maxPorts = 8
+
+// maxEchoCount caps the echo requests sent per address (?count=)
+const maxEchoCount = 10
+
+// defaultPorts are probed by the TCP fallback when the request doesn't override them
+var defaultPorts = []string{"443", "80"}
+
+// defaultUDPPorts are probed by the UDP fallback (override with udp_ports, UDP_PORTS or ?udpports=)
+var defaultUDPPorts = []string{"53", "123"}
+
+// defaultProbeOrder is the fallback chain when neither PROBE_ORDER nor ?methods= picks one;
+// "ping" is the system ping
+var defaultProbeOrder = []string{"icmp", "tcp", "udp", "ping"}
+
+// parseProbeOrder validates a comma-separated list of probe methods, which are run in the
+// given order; methods left out are not run at all
+func parseProbeOrder(spec string) ([]string, error) {
+	var methods []string
+	for _, m := range strings.Split(spec, ",") {
+		m = strings.ToLower(strings.TrimSpace(m))
+		if !slices.Contains(defaultProbeOrder, m) {
+			return nil, fmt.Errorf("unknown probe method %q (want icmp, tcp, udp or ping)", m)
+		}
+		if slices.Contains(methods, m) {
+			return nil, fmt.Errorf("probe method %q listed twice", m)
+		}
+		methods = append(methods, m)
 	}
-	// domain: only letters/digits/hyphen/dot and punycode after idna
-	ascii, err := idna.Lookup.ToASCII(s)
-	if err != nil || ascii == "" || len(ascii) > 253 {
-		return false
+	return methods, nil
+}
+
+// parseIPAddr parses a literal IP with an optional IPv6 %zone suffix; nil if s isn't one
+func parseIPAddr(s string) *net.IPAddr {
+	host, zone, _ := strings.Cut(s, "%")
+	ip := net.ParseIP(host)
+	if ip == nil || (zone != "" && ip.To4() != nil) {
+		return nil
+	}
+	return &net.IPAddr{IP: ip, Zone: zone}
+}
+
+// validZone reports whether an IPv6 zone names a real local interface
+func validZone(zone string) bool {
+	_, err := net.InterfaceByName(zone)
+	return err == nil
+}
+
+// Overall per-request probe deadline and the range a client may pick via ?timeout=
+const (
+	defaultProbeTimeout = 5 * time.Second
+	minProbeTimeout     = 500 * time.Millisecond
+	maxProbeTimeout     = 30 * time.Second
+)
+
+// probeOptions carries per-request probe settings parsed from the query string
+type probeOptions struct {
+	Ports     []string      // TCP fallback ports
+	UDPPorts  []string      // UDP fallback ports
+	Timeout   time.Duration // overall deadline for detectAndPing
+	PTR       bool          // reverse-resolve probed addresses
+	Count     int           // echo requests per address
+	TLS       bool          // inspect the certificate on port 443
+	Src       net.IP        // local source address (?src=), overriding SOURCE_IPV4/SOURCE_IPV6
+	CNAME     bool          // report the CNAME chain of domains
+	NoSysPing bool          // skip the system ping fallback (?nosysping=1)
+	Family    string        // "4" or "6" to probe only that family, "" for both
+	DNS       string        // DNS server for A/AAAA lookups (?dns=), "" for the configured resolver
+	Methods   []string      // probe methods in the order they are tried (?methods=, PROBE_ORDER)
+
+	TCPTimeout time.Duration // per-dial TCP timeout (?tcptimeout=, TCP_DIAL_TIMEOUT), 0 to scale with the race window
+
+	Payload []byte // echo data built from ?pattern=, nil for the default; replies are checked against it
+
+	MaxTTL int // TTL / hop limit of the echoes (?maxttl=), 0 for the OS default; limits probing to ICMP
+}
+
+// resolver returns the resolver for A/AAAA lookups: the ?dns= server or the configured one,
+// either way behind the names pinned in HOSTS_FILE
+func (o probeOptions) resolver() ipResolver {
+	if o.DNS != "" {
+		if r, err := newServerResolver(o.DNS); err == nil {
+			return withHosts(r)
+		}
+	}
+	return resolver
+}
+
+// netResolver is resolver for the CNAME and PTR lookups, which go to the ?dns= server, or the
+// configured upstream (see netResolver) when it is unset
+func (o probeOptions) netResolver() *net.Resolver {
+	if o.DNS != "" {
+		if r, err := newServerResolver(o.DNS); err == nil {
+			return r
+		}
 	}
-	// simple domain regex
-	var reDomain = regexp.MustCompile(`^(?i:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?(?:\.[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?)*)$`)
-	return reDomain.MatchString(ascii)
+	return netResolver
+}
+
+// checkTarget rejects a literal IP whose family contradicts ?family=
+func (o probeOptions) checkTarget(input string) error {
+	if a := parseIPAddr(input); a != nil && o.Family != "" && ipFamily(a.IP) != o.Family {
+		return fmt.Errorf("%s is not an IPv%s address", input, o.Family)
+	}
+	return nil
+}
+
+// source returns the local address probes of family should originate from, nil for the default
+func (o probeOptions) source(family string) net.IP {
+	if o.Src != nil && ipFamily(o.Src) == family {
+		return o.Src
+	}
+	return cfg.sourceAddr(family)
+}
+
+// raceWindow scales the ICMP/TCP race timeout with the overall deadline (2.2s of 5s by default)
+func (o probeOptions) raceWindow() time.Duration {
+	return o.Timeout * 22 / 50
+}
+
+// tcpDialTimeout bounds each connect of the TCP race: TCPTimeout when set, else 6/11 of the
+// race window
+func (o probeOptions) tcpDialTimeout() time.Duration {
+	if o.TCPTimeout > 0 {
+		return o.TCPTimeout
+	}
+	return o.raceWindow() * 6 / 11
+}
+
+// tcpWindow is the TCP race window, stretched when needed so a full dial always fits in it
+func (o probeOptions) tcpWindow() time.Duration {
+	return max(o.raceWindow(), o.tcpDialTimeout())
+}
+
+// defaultProbeOptions are the settings of a request that overrides nothing
+func defaultProbeOptions() probeOptions {
+	return probeOptions{Ports: cfg.Ports, UDPPorts: cfg.UDPPorts, Timeout: time.Duration(cfg.ProbeTimeout), Count: 1, Methods: cfg.ProbeOrder, TCPTimeout: time.Duration(cfg.TCPDialTimeout)}
+}
+
+// parseProbeOptions reads probe settings from the request, rejecting malformed values
+func parseProbeOptions(c *gin.Context) (probeOptions, error) {
+	opts := defaultProbeOptions()
+	if v := c.Query("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxEchoCount {
+			return opts, fmt.Errorf("count must be 1-%d", maxEchoCount)
+		}
+		opts.Count = n
+	}
+	if v := strings.TrimSpace(c.Query("timeout")); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid timeout: %q", v)
+		}
+		opts.Timeout = min(max(d, minProbeTimeout), maxProbeTimeout)
+	}
+	if v := strings.TrimSpace(c.Query("pattern")); v != "" {
+		p, err := parseEchoPattern(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.Payload = p
+	}
+	if v := strings.TrimSpace(c.Query("tcptimeout")); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("invalid tcptimeout: %q", v)
+		}
+		if d > opts.Timeout {
+			return opts, fmt.Errorf("tcptimeout %s exceeds timeout %s", d, opts.Timeout)
+		}
+		opts.TCPTimeout = d
+	} else {
+		// The configured default yields to a shorter ?timeout= rather than failing the request
+		opts.TCPTimeout = min(opts.TCPTimeout, opts.Timeout)
+	}
+	if spec := strings.TrimSpace(c.Query("ports")); spec != "" {
+		ports, err := parsePorts(spec)
+		if err != nil {
+			return opts, err
+		}
+		opts.Ports = ports
+	}
+	opts.PTR = c.Query("ptr") == "1"
+	opts.TLS = c.Query("tls") == "1"
+	opts.CNAME = c.Query("cname") == "1"
+	opts.NoSysPing = c.Query("nosysping") == "1"
+	if v := strings.TrimSpace(c.Query("dns")); v != "" {
+		if _, err := newServerResolver(v); err != nil {
+			return opts, err
+		}
+		opts.DNS = v
+	}
+	switch f := c.DefaultQuery("family", "both"); f {
+	case "4", "6":
+		opts.Family = f
+	case "both":
+	default:
+		return opts, errors.New("family must be 4, 6 or both")
+	}
+	if v := strings.TrimSpace(c.Query("src")); v != "" {
+		src, err := parseSourceAddr(v, "")
+		if err != nil {
+			return opts, err
+		}
+		opts.Src = src
+	}
+	if spec := strings.TrimSpace(c.Query("udpports")); spec != "" {
+		ports, err := parsePorts(spec)
+		if err != nil {
+			return opts, err
+		}
+		opts.UDPPorts = ports
+	}
+	if spec := strings.TrimSpace(c.Query("methods")); spec != "" {
+		methods, err := parseProbeOrder(spec)
+		if err != nil {
+			return opts, err
+		}
+		opts.Methods = methods
+	}
+	if v := c.Query("maxttl"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 255 {
+			return opts, errors.New("maxttl must be 1-255")
+		}
+		if socksDialer != nil {
+			return opts, errors.New("maxttl is unavailable through SOCKS5_PROXY")
+		}
+		opts.MaxTTL = n
+	}
+	return opts, nil
+}
+
+// parsePorts validates a comma-separated port list (1-65535, at most maxPorts)
+func parsePorts(spec string) ([]string, error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) > maxPorts {
+		return nil, fmt.Errorf("too many ports (max %d)", maxPorts)
+	}
+	ports := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("invalid port: %q", p)
+		}
+		ports = append(ports, strconv.Itoa(n))
+	}
+	return ports, nil
 }
 
 // detectAndPing uses ICMP echo concurrently for v4/v6 with fast DNS and TCP fallback
-func detectAndPing(parent context.Context, input string) pingResult {
-	ctx, cancel := context.WithTimeout(parent, 5*time.Second)
+func detectAndPing(parent context.Context, input string, opts probeOptions) pingResult {
+	ctx, cancel := context.WithTimeout(parent, opts.Timeout)
 	defer cancel()
+	ctx, span := tracer.Start(ctx, "detectAndPing", trace.WithAttributes(attribute.String("target", input), familyAttr(opts.Family)))
+	defer span.End()
+	ctx, panics := withProbePanics(ctx)
+	ctx4, ctx6 := panicScope(ctx, "4"), panicScope(ctx, "6")
 
-	res := pingResult{IPv4: "no", IPv6: "no"}
-	parsed := net.ParseIP(input)
-
-	var wg sync.WaitGroup
-	var v4ok, v6ok int32 // atomic flags
-
-	setV4 := func() { atomic.StoreInt32(&v4ok, 1) }
-	setV6 := func() { atomic.StoreInt32(&v6ok, 1) }
-
-	if parsed != nil {
-		if parsed.To4() != nil {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				if doICMP(ctx, parsed) || pingWithFamily(ctx, input, "4") {
-					setV4()
-				}
-			}()
+	start := time.Now()
+	res := pingResult{IPv4: StatusUnreachable, IPv6: StatusUnreachable, IPv4RTTms: -1, IPv6RTTms: -1, Timings: &timings{}, family: opts.Family}
+	defer func() {
+		res.Timings.TotalMs = rttMillis(time.Since(start))
+		span.SetAttributes(
+			attribute.String("ipv4", string(res.IPv4)), attribute.String("ipv6", string(res.IPv6)),
+			attribute.String("ipv4.method", res.IPv4Method), attribute.String("ipv6.method", res.IPv6Method),
+		)
+		if res.Error != "" {
+			span.SetStatus(codes.Error, res.Error)
+		}
+	}()
+	// Families excluded by ?family= are never looked at
+	switch opts.Family {
+	case "4":
+		res.IPv6 = StatusNotApplicable
+	case "6":
+		res.IPv4 = StatusNotApplicable
+	}
+	var v4ips, v6ips []net.IP
+	target := parseIPAddr(input)
+	if target != nil {
+		if target.IP.To4() != nil {
+			res.IPv4Addrs = []string{target.String()}
+			res.IPv6 = StatusNotApplicable
 		} else {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				if doICMP(ctx, parsed) || pingWithFamily(ctx, input, "6") {
-					setV6()
-				}
-			}()
+			res.IPv6Addrs = []string{target.String()}
+			res.IPv4 = StatusNotApplicable
 		}
-		wg.Wait()
-		if atomic.LoadInt32(&v4ok) == 1 {
-			res.IPv4 = "ok"
+	} else {
+		// Domain: resolve A/AAAA concurrently (with semaphore)
+		var err4, err6 error
+		// Look up the punycode form without any trailing dot; resolvers and hosts files agree on it
+		host, _ := normalizeDomain(input)
+		dnsStart := time.Now()
+		v4ips, v6ips, err4, err6 = resolveFamilies(ctx, opts.resolver(), host, opts.Family)
+		dnsMs := rttMillis(time.Since(dnsStart))
+		res.Timings.DNSms = &dnsMs
+		// Probe only the first MAX_PROBE_IPS per family so a big CDN can't fan out unbounded
+		res.IPv4Resolved, res.IPv6Resolved = len(v4ips), len(v6ips)
+		v4ips, v6ips = v4ips[:min(len(v4ips), cfg.MaxProbeIPs)], v6ips[:min(len(v6ips), cfg.MaxProbeIPs)]
+		res.IPv4Probed, res.IPv6Probed = len(v4ips), len(v6ips)
+		res.IPv4Addrs = ipStrings(v4ips)
+		res.IPv6Addrs = ipStrings(v6ips)
+		if opts.CNAME {
+			res.CNAMEChain = lookupCNAMEChain(ctx, opts.netResolver(), input)
+		}
+		// A family without addresses is a failed lookup if its query errored, else simply absent
+		for _, f := range []struct {
+			status *Status
+			ips    []net.IP
+			err    error
+		}{{&res.IPv4, v4ips, err4}, {&res.IPv6, v6ips, err6}} {
+			if len(f.ips) == 0 && *f.status != StatusNotApplicable {
+				*f.status = StatusNotApplicable
+				if f.err != nil {
+					*f.status = StatusDNSError
+				}
+			}
 		}
-		if atomic.LoadInt32(&v6ok) == 1 {
-			res.IPv6 = "ok"
+		if len(v4ips) == 0 && len(v6ips) == 0 {
+			// Report why resolution failed instead of probing nothing
+			switch {
+			case len(res.CNAMEChain) > 1:
+				// The alias exists but points nowhere: a misconfiguration, not a missing name
+				res.DanglingCNAME = true
+				res.Error = "dns: CNAME " + res.CNAMEChain[len(res.CNAMEChain)-1] + " has no A/AAAA records"
+			case err4 != nil:
+				res.Error = "dns: " + err4.Error()
+			case err6 != nil:
+				res.Error = "dns: " + err6.Error()
+			case opts.Family == "4":
+				res.Error = "dns: no A records"
+			case opts.Family == "6":
+				res.Error = "dns: no AAAA records"
+			default:
+				res.Error = "dns: no A/AAAA records"
+			}
+			// Nothing resolved: every family that was looked up failed, for whatever reason
+			status := StatusDNSError
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				res.TimedOut = true
+				status = StatusTimeout
+			}
+			if opts.Family != "6" {
+				res.IPv4 = status
+			}
+			if opts.Family != "4" {
+				res.IPv6 = status
+			}
+			res.applyPanics(panics)
+			return res
 		}
-		return res
 	}
+	res.Resolved = true
+	res.IPv4Geo = geoLookup(res.IPv4Addrs)
+	res.IPv6Geo = geoLookup(res.IPv6Addrs)
 
-	// Domain: resolve A/AAAA concurrently (with semaphore), then race ICMP and TCP (443/80)
-	type addrList struct{ v []net.IP }
-	var v4, v6 addrList
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		if !acquire(ctx, semDNS) {
-			return
+	// Probe both families concurrently
+	var wg sync.WaitGroup
+	var v4, v6 familyOutcome
+	if len(res.IPv4Addrs) > 0 {
+		goSafe(ctx4, &wg, func() {
+			v4 = probeFamily(ctx4, input, "4", target, v4ips, opts)
+		})
+	}
+	if len(res.IPv6Addrs) > 0 {
+		// Without local IPv6 (or a proxy that might have it) every method would just time out
+		if !ipv6Usable && socksDialer == nil && needsGlobalIPv6(res.IPv6Addrs) {
+			res.IPv6, res.NoLocalIPv6 = StatusNotApplicable, true
+		} else {
+			goSafe(ctx6, &wg, func() {
+				v6 = probeFamily(ctx6, input, "6", target, v6ips, opts)
+			})
 		}
-		defer release(semDNS)
-		if ips, _ := net.DefaultResolver.LookupIP(ctx, "ip4", input); len(ips) > 0 {
-			v4.v = ips
+	}
+	if opts.PTR {
+		goSafe(ctx, &wg, func() {
+			resolvePTRs(ctx, opts.netResolver(), &res)
+		})
+	}
+	if opts.TLS {
+		serverName := ""
+		if target == nil {
+			serverName, _ = normalizeDomain(input)
 		}
-	}()
-	go func() {
-		defer wg.Done()
+		res.TLS = &tlsReport{}
+		goSafe(ctx4, &wg, func() {
+			res.TLS.IPv4 = inspectTLS(ctx4, res.IPv4Addrs, "4", serverName, opts.raceWindow(), opts.source("4"))
+		})
+		goSafe(ctx6, &wg, func() {
+			res.TLS.IPv6 = inspectTLS(ctx6, res.IPv6Addrs, "6", serverName, opts.raceWindow(), opts.source("6"))
+		})
+	}
+	wg.Wait()
+	res.setOutcome(v4, v6)
+	if opts.MaxTTL > 0 {
+		res.IPv4WithinMaxTTL, res.IPv6WithinMaxTTL = v4.echo.withinTTL(), v6.echo.withinTTL()
+	}
+	if opts.Payload != nil && (v4.echo.ok() || v6.echo.ok()) {
+		intact := !v4.echo.Mangled && !v6.echo.Mangled
+		res.PayloadIntact = &intact
+	}
+	res.Timings.addPhases(v4.phases)
+	res.Timings.addPhases(v6.phases)
+	res.applyPanics(panics)
+	return res
+}
+
+// resolveFamilies looks up the A and AAAA records of host, each lookup gated by semDNS. When
+// both families are wanted a single "ip" query is tried first and its answers split by family;
+// if it fails (or DNS_SPLIT_QUERIES is set) the families are queried separately and
+// concurrently, so each gets its own error.
+//
+// Latency: the Go resolver sends the A and AAAA questions of an "ip" lookup in parallel too,
+// so both ways cost one round trip to the resolver plus the slower of the two answers. The
+// combined query holds one semDNS slot instead of two; the retry after a failed combined
+// query is the only case that pays a second round trip.
+func resolveFamilies(ctx context.Context, r ipResolver, host, family string) (v4, v6 []net.IP, err4, err6 error) {
+	lookup := func(network string, ips *[]net.IP, err *error) {
+		ctx, span := tracer.Start(ctx, "dns.lookup", trace.WithAttributes(attribute.String("target", host), attribute.String("network", network)))
+		defer func() {
+			span.SetAttributes(attribute.Int("answers", len(*ips)))
+			if *err != nil {
+				span.SetStatus(codes.Error, (*err).Error())
+			}
+			span.End()
+		}()
 		if !acquire(ctx, semDNS) {
+			*err = ctx.Err()
 			return
 		}
 		defer release(semDNS)
-		if ips, _ := net.DefaultResolver.LookupIP(ctx, "ip6", input); len(ips) > 0 {
-			v6.v = ips
+		*ips, *err = r.LookupIP(ctx, network, host)
+	}
+	if family == "" && !cfg.DNSSplitQueries {
+		var ips []net.IP
+		var err error
+		if lookup("ip", &ips, &err); err == nil {
+			v4, v6 = partitionFamilies(ips)
+			return v4, v6, nil, nil
 		}
-	}()
+		if ctx.Err() != nil {
+			return nil, nil, err, err
+		}
+	}
+	var wg sync.WaitGroup
+	if family != "6" {
+		goSafe(panicScope(ctx, "4"), &wg, func() {
+			lookup("ip4", &v4, &err4)
+		})
+	}
+	if family != "4" {
+		goSafe(panicScope(ctx, "6"), &wg, func() {
+			lookup("ip6", &v6, &err6)
+		})
+	}
 	wg.Wait()
+	return v4, v6, err4, err6
+}
 
-	ports := []string{"443", "80"}
-	var wg2 sync.WaitGroup
-	if len(v4.v) > 0 {
-		wg2.Add(1)
-		go func() {
-			defer wg2.Done()
-			if raceEcho(ctx, v4.v) || tcpConnectRace(ctx, v4.v, "4", ports) || pingWithFamily(ctx, input, "4") {
-				setV4()
-			}
-		}()
+// partitionFamilies splits mixed lookup answers into IPv4 and IPv6. An IPv4-mapped IPv6
+// answer (::ffff:a.b.c.d) counts as IPv4, since that is the family packets to it would use.
+func partitionFamilies(ips []net.IP) (v4, v6 []net.IP) {
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			v4 = append(v4, ip4)
+		} else if len(ip) == net.IPv6len {
+			v6 = append(v6, ip)
+		}
+	}
+	return v4, v6
+}
+
+// familyOutcome is the result of running the probe chain for one address family
+type familyOutcome struct {
+	method   string // probe that proved reachability, empty if none did
+	echo     echoStats
+	timedOut bool                     // the deadline fired before the chain could conclude
+	phases   map[string]time.Duration // time spent in each method that actually ran
+}
+
+// systemPingReserve is kept free at the end of the deadline so the system ping (-W 1 / -w 1500)
+// can still run and give a definitive answer
+const systemPingReserve = 1500 * time.Millisecond
+
+// probeFamily runs the fallback chain for one family in opts.Methods order (by default ICMP
+// echo, then TCP and UDP races, then the system ping), stopping at the first method that
+// proves reachability. TCP and UDP apply to domains only. A literal target is echoed directly;
+// otherwise the resolved ips are raced.
+func probeFamily(ctx context.Context, input, family string, target *net.IPAddr, ips []net.IP, opts probeOptions) (out familyOutcome) {
+	ctx, span := tracer.Start(ctx, "probeFamily", trace.WithAttributes(attribute.String("target", input), familyAttr(family)))
+	defer span.End()
+	src := opts.source(family)
+	l, closeListener := echoListener(family, src, opts.MaxTTL)
+	defer closeListener()
+	defer func() {
+		out.timedOut = out.method == "" && errors.Is(ctx.Err(), context.DeadlineExceeded)
+		span.SetAttributes(attribute.String("method", out.method), attribute.Bool("timedout", out.timedOut))
+	}()
+	methods := opts.Methods
+	if opts.MaxTTL > 0 {
+		// Only an echo tells within range from beyond it; TCP, UDP and ping would blur that
+		methods = []string{"icmp"}
+	} else if socksDialer != nil {
+		// Only TCP connects can be relayed by a SOCKS5 proxy; literal IPs get them too, since
+		// there is nothing else left to try
+		methods = []string{"tcp"}
+		if target != nil {
+			ips, target = []net.IP{target.IP}, nil
+		}
 	}
-	if len(v6.v) > 0 {
-		wg2.Add(1)
-		go func() {
-			defer wg2.Done()
-			if raceEcho(ctx, v6.v) || tcpConnectRace(ctx, v6.v, "6", ports) || pingWithFamily(ctx, input, "6") {
-				setV6()
+	// The system ping can't be pinned to a source portably, so it would test the wrong uplink
+	sysPing := src == nil && !opts.NoSysPing && !cfg.DisableSystemPing && pingPath != "" && slices.Contains(methods, "ping")
+	for i, m := range methods {
+		// Stages ahead of a pending system ping run under sctx, which ends reserve before ctx, so
+		// ping keeps time to give a definitive answer; once only the reserve is left they are
+		// skipped altogether
+		reserve := time.Duration(0)
+		if sysPing && slices.Contains(methods[i+1:], "ping") {
+			reserve = systemPingReserve
+		}
+		sctx, cancelStage := withReserve(ctx, reserve)
+		began, ran := time.Now(), m == "ping" || sctx.Err() == nil
+		switch {
+		case !ran:
+		case m == "icmp":
+			if target != nil {
+				ictx, cancel := sctx, context.CancelFunc(func() {})
+				if reserve == 0 {
+					// Nothing waits on the echo, so let it conclude inside the deadline like a race would
+					ictx, cancel = context.WithTimeout(ctx, opts.raceWindow())
+				}
+				out.echo = doICMP(ictx, l, target, opts.Count, opts.Payload)
+				cancel()
+			} else {
+				out.echo = raceEcho(sctx, l, ips, opts.raceWindow(), opts.Count, opts.Payload)
 			}
-		}()
+			if out.echo.ok() {
+				out.method = "icmp"
+			}
+		case m == "tcp":
+			if ran = target == nil; ran {
+				if port, ok := tcpConnectRace(sctx, ips, family, opts.Ports, opts.tcpWindow(), opts.tcpDialTimeout(), src); ok {
+					out.method = "tcp:" + port
+				}
+			}
+		case m == "udp":
+			if ran = target == nil; ran {
+				window := opts.raceWindow()
+				if d, ok := sctx.Deadline(); ok {
+					window = min(window, time.Until(d))
+				}
+				if ran = window > 0; ran {
+					if port, ok := udpConnectRace(sctx, ips, family, opts.UDPPorts, window, src); ok {
+						out.method = "udp:" + port
+					}
+				}
+			}
+		case m == "ping":
+			// Hand ping the address we resolved rather than the name, so the family cannot be
+			// swapped behind our back by the OS resolver's preference.
+			host := input
+			if target != nil {
+				host = target.String()
+			} else if len(ips) > 0 {
+				host = ips[0].String()
+			}
+			if ran = sysPing; ran && pingWithFamily(ctx, host, family) {
+				out.method = "system-ping"
+			}
+		}
+		cancelStage()
+		if ran {
+			if out.phases == nil {
+				out.phases = make(map[string]time.Duration, len(methods))
+			}
+			out.phases[m] = time.Since(began)
+		}
+		if out.method != "" || ctx.Err() != nil {
+			return out
+		}
 	}
-	wg2.Wait()
-	if atomic.LoadInt32(&v4ok) == 1 {
-		res.IPv4 = "ok"
+	return out
+}
+
+// lookupCNAMEChain returns [name, canonical] when name is an alias, nil otherwise. The system
+// resolver follows the whole chain, so intermediate aliases are not visible.
+func lookupCNAMEChain(ctx context.Context, r *net.Resolver, name string) []string {
+	if !acquire(ctx, semDNS) {
+		return nil
 	}
-	if atomic.LoadInt32(&v6ok) == 1 {
-		res.IPv6 = "ok"
+	defer release(semDNS)
+	host, _ := normalizeDomain(name)
+	cname, err := r.LookupCNAME(ctx, host)
+	cname = strings.TrimSuffix(cname, ".")
+	if err != nil || cname == "" || strings.EqualFold(cname, host) {
+		return nil
 	}
-	return res
+	return []string{host, cname}
 }
 
-// raceEcho pings multiple IPs concurrently and returns true if any succeeds (with semaphore)
-func raceEcho(ctx context.Context, ips []net.IP) bool {
-	ctx2, cancel := context.WithTimeout(ctx, 2200*time.Millisecond)
-	defer cancel()
+// withReserve derives a context whose deadline ends reserve before ctx's; it is already done
+// when ctx has no more than reserve left
+func withReserve(ctx context.Context, reserve time.Duration) (context.Context, context.CancelFunc) {
+	if d, ok := ctx.Deadline(); ok && reserve > 0 {
+		return context.WithDeadline(ctx, d.Add(-reserve))
+	}
+	return ctx, func() {}
+}
+
+// resolvePTRs reverse-resolves every address in res (gated by semDNS). Addresses without a
+// PTR record map to an empty list rather than an error.
+func resolvePTRs(ctx context.Context, r *net.Resolver, res *pingResult) {
+	lookup := func(addrs []string) map[string][]string {
+		out := make(map[string][]string, len(addrs))
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, a := range addrs {
+			goSafe(panicScope(ctx, ipFamily(net.ParseIP(a))), &wg, func() {
+				names := []string{}
+				if acquire(ctx, semDNS) {
+					found, _ := r.LookupAddr(ctx, a)
+					release(semDNS)
+					for _, n := range found {
+						names = append(names, strings.TrimSuffix(n, "."))
+					}
+				}
+				mu.Lock()
+				out[a] = names
+				mu.Unlock()
+			})
+		}
+		wg.Wait()
+		return out
+	}
+	if len(res.IPv4Addrs) > 0 {
+		res.IPv4PTR = lookup(res.IPv4Addrs)
+	}
+	if len(res.IPv6Addrs) > 0 {
+		res.IPv6PTR = lookup(res.IPv6Addrs)
+	}
+}
+
+// rttMillis converts an echo RTT to milliseconds (0.01ms precision), -1 if none was measured
+func rttMillis(d time.Duration) float64 {
+	if d <= 0 {
+		return -1
+	}
+	return float64(d.Microseconds()/10) / 100
+}
+
+// ipStrings converts resolved addresses to their textual form
+func ipStrings(ips []net.IP) []string {
+	out := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		out = append(out, ip.String())
+	}
+	return out
+}
 
-	done := make(chan bool, 1)
+// raceEcho pings multiple IPs concurrently (count echoes each, with semaphore) and returns the
+// stats of the first address that answered. Losing probes are cancelled and waited for, so no
+// goroutine outlives the call.
+func raceEcho(ctx context.Context, l *icmpListener, ips []net.IP, window time.Duration, count int, payload []byte) (st echoStats) {
+	ctx, span := tracer.Start(ctx, "raceEcho", trace.WithAttributes(
+		familyAttr(ipFamily(ips[0])), attribute.StringSlice("target", ipStrings(ips)), attribute.Int("count", count)))
+	defer func() {
+		span.SetAttributes(attribute.Bool("replied", st.ok()), attribute.Int("attempts", st.Attempts))
+		span.End()
+	}()
+	ctx2, cancel := context.WithTimeout(ctx, window)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	done := make(chan echoStats, 1)
 	var once sync.Once
+	var mu sync.Mutex
+	var attempts int       // most echoes any single address was sent
+	var icmpErr *icmpError // an error some address answered with instead of a reply
 	for _, ip := range ips {
 		ip := ip
-		go func() {
+		goSafe(ctx2, &wg, func() {
 			if !acquire(ctx2, semICMP) {
 				return
 			}
 			defer release(semICMP)
-			if doICMP(ctx2, ip) {
-				once.Do(func() { done <- true })
+			st := doICMP(ctx2, l, &net.IPAddr{IP: ip}, count, payload)
+			mu.Lock()
+			attempts = max(attempts, st.Attempts)
+			if st.Err != nil {
+				icmpErr = st.Err
 			}
-		}()
+			mu.Unlock()
+			if st.ok() {
+				once.Do(func() { done <- st })
+			}
+		})
 	}
+	// Addresses that answer with ICMP errors finish early; don't sit out the window for them
+	allDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(allDone)
+	}()
 	select {
-	case <-done:
-		return true
+	case st := <-done:
+		return st
+	case <-allDone:
+		// A reply is sent before its goroutine finishes, so it is already buffered
+		select {
+		case st := <-done:
+			return st
+		default:
+		}
 	case <-ctx2.Done():
-		return false
+		// The window is over, so the probes return promptly; wait to report their attempts
+		wg.Wait()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	lost := echoStats{Err: icmpErr}
+	if attempts > 0 {
+		lost.Sent, lost.Attempts = count, attempts
 	}
+	return lost
 }
 
-// tcpConnectRace tries connecting to the target IPs on given ports (any success => true)
-func tcpConnectRace(ctx context.Context, ips []net.IP, family string, ports []string) bool {
-	ctx2, cancel := context.WithTimeout(ctx, 2200*time.Millisecond)
-	defer cancel()
-	done := make(chan bool, 1)
+// tcpConnectRace tries connecting to the target IPs on given ports (any success => true) and
+// reports the port that connected. Dials originate from src when set.
+// Each dial gets a little over half of the race window; pending dials are aborted and waited
+// for once the race is decided.
+func tcpConnectRace(ctx context.Context, ips []net.IP, family string, ports []string, window, dialTimeout time.Duration, src net.IP) (port string, ok bool) {
+	ctx, span := tracer.Start(ctx, "tcpConnectRace", trace.WithAttributes(
+		familyAttr(family), attribute.StringSlice("target", ipStrings(ips)), attribute.StringSlice("ports", ports)))
+	defer func() {
+		if ok {
+			span.SetAttributes(attribute.String("method", "tcp:"+port))
+		}
+		span.End()
+	}()
+	ctx2, cancel := context.WithTimeout(ctx, window)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	done := make(chan string, 1)
 	var once sync.Once
 
 	dialNet := "tcp4"
 	if family == "6" {
 		dialNet = "tcp6"
 	}
+	// Dials time out well inside the window; stop waiting once every one of them has failed
+	allFailed := make(chan struct{})
 
 	for _, ip := range ips {
 		ip := ip
 		for _, p := range ports {
 			p := p
-			go func() {
+			goSafe(ctx2, &wg, func() {
 				if !acquire(ctx2, semTCP) {
 					return
 				}
 				defer release(semTCP)
-				d := net.Dialer{Timeout: 1200 * time.Millisecond}
-				conn, err := d.DialContext(ctx2, dialNet, net.JoinHostPort(ip.String(), p))
+				// Through SOCKS5_PROXY a successful CONNECT reply is the answer
+				dctx, cancel := context.WithTimeout(ctx2, dialTimeout)
+				conn, err := dialTCP(dctx, dialNet, net.JoinHostPort(ip.String(), p), src)
+				cancel()
 				if err == nil {
 					_ = conn.Close()
-					once.Do(func() { done <- true })
+					once.Do(func() { done <- p })
 				}
-			}()
+			})
 		}
 	}
 
+	go func() {
+		wg.Wait()
+		close(allFailed)
+	}()
+
 	select {
-	case <-done:
-		return true
+	case p := <-done:
+		return p, true
+	case <-allFailed:
+		// A success is sent before its goroutine finishes, so it is already buffered
+		select {
+		case p := <-done:
+			return p, true
+		default:
+			return "", false
+		}
 	case <-ctx2.Done():
-		return false
+		return "", false
 	}
 }
 
-// doICMP sends a single ICMP echo request to given IP using raw sockets. Returns false if not permitted.
-func doICMP(ctx context.Context, ip net.IP) bool {
-	var network, laddr string
-	var icmpType icmp.Type
-	if ip.To4() != nil {
-		network = "ip4:icmp"
-		laddr = "0.0.0.0"
-		icmpType = ipv4.ICMPTypeEcho
-	} else {
-		network = "ip6:ipv6-icmp"
-		laddr = "::"
-		icmpType = ipv6.ICMPTypeEchoRequest
-	}
+// pingPath is the absolute path of the ping binary, resolved once at startup; empty disables
+// the system ping fallback
+var pingPath string
 
-	c, err := icmp.ListenPacket(network, laddr)
-	if err != nil {
-		return false
+// setupPing resolves PING_BIN (default "ping") against PATH so the fallback never depends on
+// the PATH of a later moment, and refuses to run it when it can't be found
+func setupPing() {
+	if cfg.DisableSystemPing {
+		return
 	}
-	defer c.Close()
-
-	msg := icmp.Message{Type: icmpType, Code: 0, Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: 1, Data: []byte("ping")}}
-	b, err := msg.Marshal(nil)
+	p, err := exec.LookPath(cfg.PingBin)
 	if err != nil {
-		return false
+		slog.Warn("ping binary not found, system ping fallback disabled", "bin", cfg.PingBin, "err", err)
+		return
 	}
-
-	if deadline, ok := ctx.Deadline(); ok {
-		_ = c.SetDeadline(deadline)
+	if pingPath, err = filepath.Abs(p); err != nil {
+		pingPath = p
 	}
+	slog.Info("system ping fallback enabled", "path", pingPath)
+}
+
+// pingWaitDelay bounds how long an aborted system ping may keep its output pipe open
+const pingWaitDelay = 100 * time.Millisecond
 
-	if _, err = c.WriteTo(b, &net.IPAddr{IP: ip}); err != nil {
+// pingWithFamily executes the system ping command for IPv4(-4) or IPv6(-6) as fallback.
+// Several implementations exit 0 after "Destination Host Unreachable" or even 100% loss,
+// so success additionally requires a reply line in the output.
+func pingWithFamily(ctx context.Context, host string, family string) bool {
+	if pingPath == "" {
 		return false
 	}
-
-	buf := make([]byte, 1500)
-	for {
-		select {
-		case <-ctx.Done():
-			return false
-		default:
-			n, _, err := c.ReadFrom(buf)
-			if err != nil {
-				if ne, ok := err.(net.Error); ok && ne.Timeout() {
-					return false
-				}
-				if errors.Is(err, os.ErrDeadlineExceeded) {
-					return false
-				}
-				return false
-			}
-			rm, err := icmp.ParseMessage(getProto(ip), buf[:n])
-			if err == nil && (rm.Type == ipv4.ICMPTypeEchoReply || rm.Type == ipv6.ICMPTypeEchoReply) {
-				return true
-			}
+	var args []string
+	if runtime.GOOS == "windows" {
+		args = []string{"-n", "1", "-w", "1500", host}
+	} else {
+		// "--" ends option parsing so the host can never be taken as a flag
+		args = []string{"-c", "1", "-W", "1", "--", host}
+		if cfg.ProbeVRF != "" {
+			// iputils binds to the device with SO_BINDTODEVICE as well
+			args = append([]string{"-I", cfg.ProbeVRF}, args...)
 		}
 	}
+	if family == "4" {
+		args = append([]string{"-4"}, args...)
+	} else {
+		args = append([]string{"-6"}, args...)
+	}
+	cmd := exec.CommandContext(ctx, pingPath, args...)
+	setPingProcess(cmd)
+	// Should anything outside the group still hold the output pipe, stop waiting for it
+	cmd.WaitDelay = pingWaitDelay
+	out, err := cmd.Output()
+	return err == nil && pingReplied(out)
 }
 
-func getProto(ip net.IP) int {
-	if ip.To4() != nil {
-		return 1
-	}
-	return 58
+// pingReplyPatterns recognise an echo reply line across iputils, BSD/macOS, BusyBox and
+// Windows ping. "bytes from", "ttl=" and "time=" stay untranslated in most locales; the
+// last pattern catches localized Windows timing fields such as "Zeit=12ms" or "时间<1ms".
+// Unreachable, timeout and summary lines match none of them.
+var pingReplyPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\bbytes from\b`),
+	regexp.MustCompile(`(?i)\bttl=\d`),
+	regexp.MustCompile(`(?i)\btime[=<]\s*[\d.]+`),
+	regexp.MustCompile(`时间[=<]\s*[\d.]+`),
+	regexp.MustCompile(`[=<]\s*\d+\s*ms\b`),
 }
 
-// pingWithFamily executes the system ping command for IPv4(-4) or IPv6(-6) as fallback.
-func pingWithFamily(ctx context.Context, host string, family string) bool {
-	osn := runtime.GOOS
-	var cmd *exec.Cmd
-	if osn == "windows" {
-		args := []string{"-n", "1", "-w", "1500"}
-		if family == "4" {
-			args = append([]string{"-4"}, args...)
-		} else {
-			args = append([]string{"-6"}, args...)
+// pingErrorLine marks ICMP errors reported in a reply-like line, as BSD/macOS ping does with
+// "92 bytes from 10.0.0.1: Destination Host Unreachable"
+var pingErrorLine = regexp.MustCompile(`(?i)unreachable|exceeded|prohibited`)
+
+// pingReplied reports whether ping output contains evidence of a genuine echo reply.
+// Windows statistics ("Minimum = 0ms, Maximum = 0ms, ...") list comma-separated values
+// and are skipped so the timing pattern cannot match them.
+func pingReplied(out []byte) bool {
+	for line := range strings.Lines(string(out)) {
+		if strings.Contains(line, ",") || pingErrorLine.MatchString(line) {
+			continue
 		}
-		args = append(args, host)
-		cmd = exec.CommandContext(ctx, "ping", args...)
-	} else {
-		args := []string{"-c", "1"}
-		if family == "4" {
-			args = append([]string{"-4"}, args...)
-		} else {
-			args = append([]string{"-6"}, args...)
+		for _, re := range pingReplyPatterns {
+			if re.MatchString(line) {
+				return true
+			}
 		}
-		args = append(args, "-W", "1", host)
-		cmd = exec.CommandContext(ctx, "ping", args...)
-	}
-	if err := cmd.Run(); err != nil {
-		return false
 	}
-	return true
+	return false
 }
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// setupTest loads the default configuration (plus any environment) and sizes the semaphores
+// and worker pool from it, as main does before serving
+func setupTest(t testing.TB) {
+	t.Helper()
+	c, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = c
+	setupSemaphores(cfg)
+}
+
+func TestPingReplied(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want bool
+	}{
+		{"iputils reply", `PING 1.1.1.1 (1.1.1.1) 56(84) bytes of data.
+64 bytes from 1.1.1.1: icmp_seq=1 ttl=57 time=12.3 ms
+
+--- 1.1.1.1 ping statistics ---
+1 packets transmitted, 1 received, 0% packet loss, time 0ms
+rtt min/avg/max/mdev = 12.345/12.345/12.345/0.000 ms
+`, true},
+		{"iputils loss", `PING 192.0.2.1 (192.0.2.1) 56(84) bytes of data.
+
+--- 192.0.2.1 ping statistics ---
+1 packets transmitted, 0 received, 100% packet loss, time 0ms
+`, false},
+		{"iputils unreachable", `PING 10.0.0.99 (10.0.0.99) 56(84) bytes of data.
+From 10.0.0.1 icmp_seq=1 Destination Host Unreachable
+
+--- 10.0.0.99 ping statistics ---
+1 packets transmitted, 0 received, +1 errors, 100% packet loss, time 0ms
+`, false},
+		{"iputils ipv6 reply", `PING 2606:4700:4700::1111(2606:4700:4700::1111) 56 data bytes
+64 bytes from 2606:4700:4700::1111: icmp_seq=1 ttl=58 time=9.87 ms
+
+--- 2606:4700:4700::1111 ping statistics ---
+1 packets transmitted, 1 received, 0% packet loss, time 0ms
+`, true},
+		{"macos reply", `PING 1.1.1.1 (1.1.1.1): 56 data bytes
+64 bytes from 1.1.1.1: icmp_seq=0 ttl=57 time=12.345 ms
+
+--- 1.1.1.1 ping statistics ---
+1 packets transmitted, 1 packets received, 0.0% packet loss
+round-trip min/avg/max/stddev = 12.345/12.345/12.345/0.000 ms
+`, true},
+		{"macos loss", `PING 192.0.2.1 (192.0.2.1): 56 data bytes
+Request timeout for icmp_seq 0
+
+--- 192.0.2.1 ping statistics ---
+1 packets transmitted, 0 packets received, 100.0% packet loss
+`, false},
+		{"macos unreachable", `PING 10.0.0.99 (10.0.0.99): 56 data bytes
+92 bytes from 10.0.0.1: Destination Host Unreachable
+Vr HL TOS  Len   ID Flg  off TTL Pro  cks      Src      Dst
+ 4  5  00 5400 1c2d   0 0000  40  01 4a5b 10.0.0.2  10.0.0.99
+
+--- 10.0.0.99 ping statistics ---
+1 packets transmitted, 0 packets received, 100.0% packet loss
+`, false},
+		{"busybox reply", `PING 1.1.1.1 (1.1.1.1): 56 data bytes
+64 bytes from 1.1.1.1: seq=0 ttl=57 time=12.345 ms
+
+--- 1.1.1.1 ping statistics ---
+1 packets transmitted, 1 packets received, 0% packet loss
+round-trip min/avg/max = 12.345/12.345/12.345 ms
+`, true},
+		{"busybox loss", `PING 192.0.2.1 (192.0.2.1): 56 data bytes
+
+--- 192.0.2.1 ping statistics ---
+1 packets transmitted, 0 packets received, 100% packet loss
+`, false},
+		{"windows reply", "\r\nPinging 1.1.1.1 with 32 bytes of data:\r\n" +
+			"Reply from 1.1.1.1: bytes=32 time=12ms TTL=57\r\n\r\n" +
+			"Ping statistics for 1.1.1.1:\r\n" +
+			"    Packets: Sent = 1, Received = 1, Lost = 0 (0% loss),\r\n" +
+			"Approximate round trip times in milli-seconds:\r\n" +
+			"    Minimum = 12ms, Maximum = 12ms, Average = 12ms\r\n", true},
+		{"windows sub-millisecond reply", "Reply from 192.168.1.1: bytes=32 time<1ms TTL=64\r\n", true},
+		{"windows loss", "\r\nPinging 192.0.2.1 with 32 bytes of data:\r\n" +
+			"Request timed out.\r\n\r\n" +
+			"Ping statistics for 192.0.2.1:\r\n" +
+			"    Packets: Sent = 1, Received = 0, Lost = 1 (100% loss),\r\n", false},
+		{"windows unreachable", "\r\nPinging 10.0.0.99 with 32 bytes of data:\r\n" +
+			"Reply from 10.0.0.1: Destination host unreachable.\r\n\r\n" +
+			"Ping statistics for 10.0.0.99:\r\n" +
+			"    Packets: Sent = 1, Received = 1, Lost = 0 (0% loss),\r\n", false},
+		{"windows german reply", "\r\nPing wird ausgeführt für 1.1.1.1 mit 32 Bytes Daten:\r\n" +
+			"Antwort von 1.1.1.1: Bytes=32 Zeit=12ms TTL=57\r\n\r\n" +
+			"Ping-Statistik für 1.1.1.1:\r\n" +
+			"    Pakete: Gesendet = 1, Empfangen = 1, Verloren = 0\r\n" +
+			"    (0% Verlust),\r\n", true},
+		{"windows german loss", "\r\nPing wird ausgeführt für 192.0.2.1 mit 32 Bytes Daten:\r\n" +
+			"Zeitüberschreitung der Anforderung.\r\n\r\n" +
+			"Ping-Statistik für 192.0.2.1:\r\n" +
+			"    Pakete: Gesendet = 1, Empfangen = 0, Verloren = 1\r\n" +
+			"    (100% Verlust),\r\n", false},
+		{"windows german unreachable", "Antwort von 10.0.0.1: Zielhost nicht erreichbar.\r\n", false},
+		{"windows french reply", "Réponse de 1.1.1.1 : octets=32 temps=12 ms TTL=57\r\n", true},
+		{"windows french loss", "Délai d’attente de la demande dépassé.\r\n" +
+			"    Paquets : envoyés = 1, reçus = 0, perdus = 1 (perte 100%),\r\n", false},
+		{"windows chinese reply", "\r\n正在 Ping 1.1.1.1 具有 32 字节的数据:\r\n" +
+			"来自 1.1.1.1 的回复: 字节=32 时间=12ms TTL=57\r\n\r\n" +
+			"1.1.1.1 的 Ping 统计信息:\r\n" +
+			"    数据包: 已发送 = 1，已接收 = 1，丢失 = 0 (0% 丢失)，\r\n", true},
+		{"windows chinese sub-millisecond reply", "来自 192.168.1.1 的回复: 字节=32 时间<1ms TTL=64\r\n", true},
+		{"windows chinese loss", "\r\n正在 Ping 192.0.2.1 具有 32 字节的数据:\r\n" +
+			"请求超时。\r\n\r\n" +
+			"192.0.2.1 的 Ping 统计信息:\r\n" +
+			"    数据包: 已发送 = 1，已接收 = 0，丢失 = 1 (100% 丢失)，\r\n", false},
+		{"windows chinese unreachable", "来自 10.0.0.1 的回复: 无法访问目标主机。\r\n", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pingReplied([]byte(tt.out)); got != tt.want {
+				t.Errorf("pingReplied() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeDomain(t *testing.T) {
+	long := strings.Repeat("a", 63)
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"example.com", "example.com", true},
+		{"_dmarc.example.com", "_dmarc.example.com", true},
+		{"_sip._tcp.example.com", "_sip._tcp.example.com", true},
+		{"example.com.", "example.com", true},
+		{"example.com..", "", false},
+		{"münchen.de", "xn--mnchen-3ya.de", true},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah", true},
+		{"EXAMPLE.com", "example.com", true},
+		{long + ".com", long + ".com", true},
+		{long + "a.com", "", false},
+		{strings.Repeat(long+".", 4) + "com", "", false}, // 256 characters
+		{"-example.com", "", false},
+		{"example-.com", "", false},
+		{"exa mple.com", "", false},
+		{"a..b", "", false},
+		{"", "", false},
+		{".", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok := normalizeDomain(tt.in)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("normalizeDomain(%q) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestIsValidInput(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"1.1.1.1", true},
+		{"2606:4700:4700::1111", true},
+		{"::1", true},
+		{"[2606:4700:4700::1111]", false},
+		{"fe80::1%lo", true},
+		{"fe80::1%nosuchif0", false},
+		{"_dmarc.example.com", true},
+		{"example.com.", true},
+		{"münchen.de", true},
+		{strings.Repeat("a", 64) + ".com", false},
+		{strings.Repeat("a", 256), false},
+		{"", false},
+		{"http://example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := isValidInput(tt.in); got != tt.want {
+				t.Errorf("isValidInput(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectAndPingCancelUnwinds(t *testing.T) {
+	setupTest(t)
+	setupPing()
+	startICMPListeners()
+	t.Cleanup(stopICMPListeners)
+	// A name pinned to TEST-NET-1 also runs the TCP and UDP races, which literals skip
+	saved, savedHosts := resolver, staticHosts
+	staticHosts = map[string][]net.IP{"blackhole.test": {net.ParseIP("192.0.2.1")}}
+	resolver = withHosts(resolver)
+	t.Cleanup(func() { resolver, staticHosts = saved, savedHosts })
+
+	for _, input := range []string{"192.0.2.1", "blackhole.test"} {
+		t.Run(input, func(t *testing.T) {
+			base := runtime.NumGoroutine()
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			start := time.Now()
+			detectAndPing(ctx, input, defaultProbeOptions())
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("detectAndPing returned %v after cancel", d)
+			}
+			deadline := time.Now().Add(2 * time.Second)
+			for runtime.NumGoroutine() > base && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if n := runtime.NumGoroutine(); n > base {
+				buf := make([]byte, 1<<16)
+				t.Errorf("%d goroutines left running after cancel (baseline %d):\n%s", n-base, base, buf[:runtime.Stack(buf, true)])
+			}
+		})
+	}
+}
+
+func TestPingWithFamilyCancel(t *testing.T) {
+	setupTest(t)
+	setupPing()
+	if pingPath == "" {
+		t.Skip("no system ping")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if pingWithFamily(ctx, "192.0.2.1", "4") {
+		t.Error("cancelled ping reported a reply")
+	}
+	// -W 1 would let an unkilled ping run for a second
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("pingWithFamily returned %v after start, want prompt return on cancel", d)
+	}
+}
+
+// stubResolver returns a Go resolver whose queries are answered in memory: A and AAAA from
+// answers (NXDOMAIN-free empty answer when a type is missing), SERVFAIL for types in fail
+func stubResolver(answers map[dnsmessage.Type][]net.IP, fail ...dnsmessage.Type) *net.Resolver {
+	return &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go serveStubDNS(server, answers, fail)
+		return client, nil
+	}}
+}
+
+// serveStubDNS answers the length-prefixed queries the resolver writes to a stream connection
+func serveStubDNS(conn net.Conn, answers map[dnsmessage.Type][]net.IP, fail []dnsmessage.Type) {
+	defer conn.Close()
+	for {
+		var n [2]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(n[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		var q dnsmessage.Message
+		if q.Unpack(buf) != nil || len(q.Questions) != 1 {
+			return
+		}
+		qq := q.Questions[0]
+		m := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: q.ID, Response: true, RecursionAvailable: true},
+			Questions: q.Questions,
+		}
+		if slices.Contains(fail, qq.Type) {
+			m.RCode = dnsmessage.RCodeServerFailure
+		}
+		for _, ip := range answers[qq.Type] {
+			h := dnsmessage.ResourceHeader{Name: qq.Name, Type: qq.Type, Class: dnsmessage.ClassINET, TTL: 60}
+			if qq.Type == dnsmessage.TypeA {
+				m.Answers = append(m.Answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.AResource{A: [4]byte(ip.To4())}})
+			} else {
+				m.Answers = append(m.Answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())}})
+			}
+		}
+		out, err := m.Pack()
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(out))), out...)); err != nil {
+			return
+		}
+	}
+}
+
+func TestResolveFamilies(t *testing.T) {
+	setupTest(t)
+	v4 := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}
+	v6 := []net.IP{net.ParseIP("2001:db8::1")}
+	mixed := map[dnsmessage.Type][]net.IP{dnsmessage.TypeA: v4, dnsmessage.TypeAAAA: v6}
+	tests := []struct {
+		name       string
+		answers    map[dnsmessage.Type][]net.IP
+		fail       []dnsmessage.Type
+		family     string
+		split      bool
+		want4      []string
+		want6      []string
+		err4, err6 bool
+	}{
+		{name: "mixed", answers: mixed, want4: []string{"192.0.2.1", "192.0.2.2"}, want6: []string{"2001:db8::1"}},
+		{name: "mixed split", answers: mixed, split: true, want4: []string{"192.0.2.1", "192.0.2.2"}, want6: []string{"2001:db8::1"}},
+		{name: "family 4", answers: mixed, family: "4", want4: []string{"192.0.2.1", "192.0.2.2"}},
+		{name: "family 6", answers: mixed, family: "6", want6: []string{"2001:db8::1"}},
+		{name: "v4 only", answers: map[dnsmessage.Type][]net.IP{dnsmessage.TypeA: v4}, want4: []string{"192.0.2.1", "192.0.2.2"}},
+		// The combined lookup hides which family failed; split queries report it
+		{name: "aaaa servfail", answers: mixed, fail: []dnsmessage.Type{dnsmessage.TypeAAAA}, want4: []string{"192.0.2.1", "192.0.2.2"}},
+		{name: "aaaa servfail split", answers: mixed, fail: []dnsmessage.Type{dnsmessage.TypeAAAA}, split: true, want4: []string{"192.0.2.1", "192.0.2.2"}, err6: true},
+		{name: "both servfail", answers: mixed, fail: []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}, err4: true, err6: true},
+		{name: "v4-mapped aaaa", answers: map[dnsmessage.Type][]net.IP{dnsmessage.TypeAAAA: {net.ParseIP("::ffff:192.0.2.9")}}, want4: []string{"192.0.2.9"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.DNSSplitQueries = tt.split
+			r := stubResolver(tt.answers, tt.fail...)
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			got4, got6, err4, err6 := resolveFamilies(ctx, r, "host.example.test", tt.family)
+			if s := ipStrings(got4); !slices.Equal(s, tt.want4) {
+				t.Errorf("v4 = %v, want %v", s, tt.want4)
+			}
+			if s := ipStrings(got6); !slices.Equal(s, tt.want6) {
+				t.Errorf("v6 = %v, want %v", s, tt.want6)
+			}
+			if (err4 != nil) != tt.err4 || (err6 != nil) != tt.err6 {
+				t.Errorf("err4 = %v, err6 = %v, want errors %v/%v", err4, err6, tt.err4, tt.err6)
+			}
+			var dnsErr *net.DNSError
+			for _, err := range []error{err4, err6} {
+				if err != nil && !errors.As(err, &dnsErr) {
+					t.Errorf("error %v is not a *net.DNSError", err)
+				}
+			}
+		})
+	}
+}
+
+// rttConn delays each query written to it by rtt, standing in for the round trip to a resolver
+type rttConn struct {
+	net.Conn
+	rtt time.Duration
+}
+
+func (c rttConn) Write(p []byte) (int, error) {
+	time.Sleep(c.rtt)
+	return c.Conn.Write(p)
+}
+
+// BenchmarkResolveFamilies compares one combined lookup with DNS_SPLIT_QUERIES' per-family
+// lookups, against the stub server both immediately and across a simulated 2ms round trip
+func BenchmarkResolveFamilies(b *testing.B) {
+	setupTest(b)
+	answers := map[dnsmessage.Type][]net.IP{
+		dnsmessage.TypeA:    {net.ParseIP("192.0.2.1")},
+		dnsmessage.TypeAAAA: {net.ParseIP("2001:db8::1")},
+	}
+	for _, rtt := range []time.Duration{0, 2 * time.Millisecond} {
+		r := stubResolver(answers)
+		if rtt > 0 {
+			dial := r.Dial
+			r.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+				conn, err := dial(ctx, network, address)
+				return rttConn{conn, rtt}, err
+			}
+		}
+		for _, split := range []bool{false, true} {
+			mode := map[bool]string{false: "single", true: "split"}[split]
+			b.Run("rtt="+rtt.String()+"/"+mode, func(b *testing.B) {
+				cfg.DNSSplitQueries = split
+				ctx := context.Background()
+				for b.Loop() {
+					if v4, v6, err4, err6 := resolveFamilies(ctx, r, "host.example.test", ""); len(v4) != 1 || len(v6) != 1 {
+						b.Fatalf("v4 = %v (%v), v6 = %v (%v)", v4, err4, v6, err6)
+					}
+				}
+			})
+		}
+	}
+	cfg.DNSSplitQueries = false
+}
+
+func TestPartitionFamilies(t *testing.T) {
+	v4, v6 := partitionFamilies([]net.IP{
+		net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1"), net.ParseIP("::ffff:198.51.100.7"), {1, 2, 3},
+	})
+	if s := ipStrings(v4); !slices.Equal(s, []string{"192.0.2.1", "198.51.100.7"}) {
+		t.Errorf("v4 = %v", s)
+	}
+	if s := ipStrings(v6); !slices.Equal(s, []string{"2001:db8::1"}) {
+		t.Errorf("v6 = %v", s)
+	}
+	for _, ip := range v4 {
+		if len(ip) != net.IPv4len {
+			t.Errorf("%v not in 4-byte form", ip)
+		}
+	}
+}
+
+func TestGoSafeFailsOnlyItsFamily(t *testing.T) {
+	ctx, panics := withProbePanics(context.Background())
+	var wg sync.WaitGroup
+	goSafe(panicScope(ctx, "6"), &wg, func() { panic("boom") })
+	goSafe(panicScope(ctx, "4"), &wg, func() {})
+	wg.Wait()
+	res := pingResult{IPv4: StatusReachable, IPv6: StatusReachable}
+	res.applyPanics(panics)
+	if res.IPv4 != StatusReachable || res.IPv6 != StatusError {
+		t.Errorf("statuses = %s/%s, want reachable/error", res.IPv4, res.IPv6)
+	}
+	if !strings.Contains(res.Error, "boom") {
+		t.Errorf("error = %q", res.Error)
+	}
+}
+
+func TestEnvZeroOverridesFile(t *testing.T) {
+	t.Cleanup(func() { envErrors = nil })
+	envErrors = nil
+	t.Setenv("CACHE_TTL", "0")
+	t.Setenv("MAX_ICMP", "0")
+	c := Config{CacheTTL: duration(time.Minute), MaxICMP: 100}
+	if err := c.applyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if c.CacheTTL != 0 {
+		t.Errorf("CACHE_TTL=0 left cache_ttl at %v", time.Duration(c.CacheTTL))
+	}
+	if c.MaxICMP != 100 || len(envErrors) != 1 {
+		t.Errorf("MAX_ICMP=0: max_icmp = %d, %d env errors; want 100 and 1", c.MaxICMP, len(envErrors))
+	}
+}
+
+func TestRegisterNoFreeSequence(t *testing.T) {
+	setupTest(t)
+	l := &icmpListener{dgram: true, waiters: map[echoKey]chan echoReply{}}
+	for seq := range 1 << 16 {
+		l.waiters[echoKey{seq: seq}] = nil
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, _, _, err := l.register(make(chan echoReply, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errNoFreeSequence) {
+			t.Errorf("register with every sequence outstanding = %v, want %v", err, errNoFreeSequence)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("register spun with every sequence outstanding")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// Probe interval for /ws/monitor: the default and the floor that keeps a single socket from
+// turning into a flood
+const (
+	defaultMonitorInterval = 5 * time.Second
+	minMonitorInterval     = time.Second
+)
+
+// maxMonitorsPerClient keeps one client from taking every one of the MAX_MONITORS sockets
+const maxMonitorsPerClient = 8
+
+// monitors counts the open /ws/monitor sockets, each of which probes until it is closed
+var monitors = struct {
+	sync.Mutex
+	total    int
+	byClient map[string]int
+}{byClient: map[string]int{}}
+
+// openMonitor claims a monitor socket for client, returning 0 or the status to refuse it with:
+// 429 when the client has maxMonitorsPerClient open already, 503 when MAX_MONITORS are
+func openMonitor(client string) int {
+	monitors.Lock()
+	defer monitors.Unlock()
+	switch {
+	case monitors.byClient[client] >= maxMonitorsPerClient:
+		return http.StatusTooManyRequests
+	case monitors.total >= cfg.MaxMonitors:
+		return http.StatusServiceUnavailable
+	}
+	monitors.total++
+	monitors.byClient[client]++
+	return 0
+}
+
+// closeMonitor releases a socket claimed by openMonitor
+func closeMonitor(client string) {
+	monitors.Lock()
+	defer monitors.Unlock()
+	monitors.total--
+	if monitors.byClient[client]--; monitors.byClient[client] == 0 {
+		delete(monitors.byClient, client)
+	}
+}
+
+// handleMonitor upgrades GET /ws/monitor?ip=host&interval=5s to a WebSocket and pushes one
+// JSON result per interval until the client disconnects or the server shuts down
+func handleMonitor(c *gin.Context) {
+	input := pingInput(c)
+	if !isValidInput(input) {
+		abortWithError(c, 400, "invalid ip or domain")
+		return
+	}
+	opts, err := parseProbeOptions(c)
+	if err == nil {
+		err = opts.checkTarget(input)
+	}
+	if err != nil {
+		abortWithError(c, 400, err.Error())
+		return
+	}
+	interval := defaultMonitorInterval
+	if v := strings.TrimSpace(c.Query("interval")); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			abortWithError(c, 400, "invalid interval: "+v)
+			return
+		}
+		interval = max(d, minMonitorInterval)
+	}
+	// Checked before the upgrade too, so a refusal is a normal (logged) 403 response
+	if err := checkMonitorOrigin(&websocket.Config{}, c.Request); err != nil {
+		abortWithError(c, 403, err.Error())
+		return
+	}
+	client := c.ClientIP()
+	if status := openMonitor(client); status != 0 {
+		c.Header("Retry-After", strconv.Itoa(int(defaultMonitorInterval.Seconds())))
+		abortWithError(c, status, "too many monitor sockets open")
+		return
+	}
+	defer closeMonitor(client)
+
+	srv := websocket.Server{
+		Handshake: checkMonitorOrigin,
+		Handler: func(ws *websocket.Conn) {
+			monitor(c.Request.Context(), ws, input, opts, interval)
+		},
+	}
+	srv.ServeHTTP(c.Writer, c.Request)
+}
+
+// monitor probes input immediately and then on every tick, writing each result to ws
+func monitor(parent context.Context, ws *websocket.Conn, input string, opts probeOptions, interval time.Duration) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	// The hijacked connection keeps the server's read/write deadlines; lift them
+	_ = ws.SetDeadline(time.Time{})
+	// Clients only ever close the socket; a failed read is how a disconnect shows up
+	go func() {
+		defer cancel()
+		var discard string
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// Each probe gets a fresh result: a monitor that reads from the cache shows nothing
+		res := detectAndPing(ctx, input, opts)
+		if oe := overloaded(parent); oe != nil {
+			// Shed by ACQUIRE_TIMEOUT; past the upgrade, a last message is the only way to say so
+			_ = ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			_ = websocket.JSON.Send(ws, apiResponse{Code: http.StatusServiceUnavailable, Msg: oe.Error()})
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		_ = ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if websocket.JSON.Send(ws, batchResult{Input: input, pingResult: res}) != nil {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkMonitorOrigin refuses browser upgrades from foreign pages (cross-site WebSocket
+// hijacking): the Origin must be this host or one of CORS_ORIGINS. Clients that send no
+// Origin, such as scripts, are not browsers and are let through.
+func checkMonitorOrigin(config *websocket.Config, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if u.Host == req.Host || slices.Contains(cfg.CORSOrigins, "*") || slices.Contains(cfg.CORSOrigins, origin) {
+		config.Origin = u
+		return nil
+	}
+	return errors.New("origin not allowed")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+
+	"github.com/gin-gonic/gin"
+)
+
+// egressAnchors are the public addresses /api/myip "connects" to in order to learn the local
+// address the routing table picks for each family. Connecting a UDP socket sends nothing.
+var egressAnchors = map[string]string{
+	"4": "8.8.8.8:53",
+	"6": "[2001:4860:4860::8888]:53",
+}
+
+// egressAddr is one family's outbound source address in /api/myip
+type egressAddr struct {
+	Available bool   `json:"available"`
+	Address   string `json:"address,omitempty"`
+	Public    bool   `json:"public"`          // false when the host sits behind NAT for this family
+	Error     string `json:"error,omitempty"` // why there is no route, when unavailable
+}
+
+// myIPResult is the data of /api/myip
+type myIPResult struct {
+	IPv4 egressAddr `json:"ipv4"`
+	IPv6 egressAddr `json:"ipv6"`
+}
+
+// egressSource asks the kernel which local address it would send family's traffic from,
+// honouring the configured source address
+func egressSource(family string) egressAddr {
+	d := net.Dialer{LocalAddr: dialLocalAddr("udp", cfg.sourceAddr(family)), Control: vrfControl}
+	conn, err := d.Dial("udp"+family, egressAnchors[family])
+	if err != nil {
+		return egressAddr{Error: err.Error()}
+	}
+	defer conn.Close()
+	ip := conn.LocalAddr().(*net.UDPAddr).IP
+	return egressAddr{
+		Available: true,
+		Address:   ip.String(),
+		Public:    ip.IsGlobalUnicast() && !ip.IsPrivate(),
+	}
+}
+
+// handleMyIP serves GET /api/myip: the source addresses this server would probe from
+func handleMyIP(c *gin.Context) {
+	c.JSON(200, apiResponse{Code: 200, Msg: "success", Data: myIPResult{
+		IPv4: egressSource("4"),
+		IPv6: egressSource("6"),
+	}})
+}
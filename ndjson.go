@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handlePingNDJSON serves GET /api/ping/ndjson?ip=target as a single JSON line
+func handlePingNDJSON(c *gin.Context) {
+	input := pingInput(c)
+	if !isValidInput(input) {
+		abortWithError(c, 400, "invalid ip or domain")
+		return
+	}
+	opts, err := parseProbeOptions(c)
+	if err == nil {
+		err = opts.checkTarget(input)
+	}
+	if err != nil {
+		abortWithError(c, 400, err.Error())
+		return
+	}
+	res, cs := cachedDetectAndPing(c.Request.Context(), input, opts)
+	logProbe(c, input, res)
+	if setCacheHeaders(c, cs, "application/x-ndjson", input, res) {
+		return
+	}
+	streamNDJSON(c, 1, func(context.Context, int) any { return batchResult{Input: input, pingResult: res} })
+}
+
+// handleBatchNDJSON serves POST /api/ping/ndjson with a batch body, writing one JSON line per
+// target as each finishes and a final {"done":{"count":n,"errors":e}} line once all have
+func handleBatchNDJSON(c *gin.Context) {
+	req, opts, ok := bindBatch(c)
+	if !ok {
+		return
+	}
+	s, done := streamNDJSON(c, len(req.Targets), func(ctx context.Context, i int) any {
+		return batchResult{Input: req.Targets[i], pingResult: safeResult(ctx, req.Targets[i], opts)}
+	})
+	if done {
+		_ = json.NewEncoder(c.Writer).Encode(gin.H{"done": s})
+	}
+}
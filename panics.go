@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+)
+
+// probePanics records the first panic recovered from the goroutines probing each family of one
+// target, so detectAndPing can report that family as StatusError instead of crashing
+type probePanics struct {
+	mu     sync.Mutex
+	v4, v6 any
+}
+
+// probePanicsKey carries a target's *probePanics; panicFamilyKey the family ("4", "6") that
+// goroutines started under a context work for
+type (
+	probePanicsKey struct{}
+	panicFamilyKey struct{}
+)
+
+// withProbePanics returns ctx carrying a fresh recorder for the goroutines started under it
+func withProbePanics(ctx context.Context) (context.Context, *probePanics) {
+	p := &probePanics{}
+	return context.WithValue(ctx, probePanicsKey{}, p), p
+}
+
+// panicScope marks ctx as working for family, so a panic under it fails only that family
+func panicScope(ctx context.Context, family string) context.Context {
+	return context.WithValue(ctx, panicFamilyKey{}, family)
+}
+
+// goSafe runs fn on a new goroutine counted by wg, like wg.Go. A panic is logged with its stack
+// and recorded for the family ctx is scoped to rather than taking the whole process down; wg is
+// released only after that, so whoever waits on it sees the failure.
+func goSafe(ctx context.Context, wg *sync.WaitGroup, fn func()) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer recoverProbe(ctx)
+		fn()
+	}()
+}
+
+func recoverProbe(ctx context.Context) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	family, _ := ctx.Value(panicFamilyKey{}).(string)
+	slog.Error("probe panicked", "family", family, "panic", v, "stack", string(debug.Stack()))
+	p, ok := ctx.Value(probePanicsKey{}).(*probePanics)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if family != "6" && p.v4 == nil {
+		p.v4 = v
+	}
+	if family != "4" && p.v6 == nil {
+		p.v6 = v
+	}
+}
+
+// applyPanics marks the families whose probes panicked as StatusError
+func (r *pingResult) applyPanics(p *probePanics) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, f := range []struct {
+		status *Status
+		v      any
+	}{{&r.IPv4, p.v4}, {&r.IPv6, p.v6}} {
+		if f.v == nil {
+			continue
+		}
+		*f.status = StatusError
+		if r.Error == "" {
+			r.Error = fmt.Sprintf("internal error: %v", f.v)
+		}
+	}
+}
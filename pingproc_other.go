@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// setPingProcess keeps exec.CommandContext's default of killing just the ping process, as
+// there are no process groups to signal here
+func setPingProcess(*exec.Cmd) {}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// probePool runs the per-target probes of batches, scans and streams (MAX_WORKERS)
+var probePool *workerPool
+
+// workerIdle is how long a worker waits for another task before exiting
+const workerIdle = 10 * time.Second
+
+// workerPool bounds how many goroutines run tasks at once. Workers start on demand, take queued
+// tasks while there are any and exit once idle, so a burst leaves nothing behind. Submitting
+// blocks while every worker is busy: a large fan-out waits as one blocked submitter instead of
+// thousands of goroutines parked in acquire.
+//
+// Only leaf fan-outs may use it: a task that submitted to the same pool and waited could
+// deadlock once every worker did so. The races inside one probe (a few addresses times a few
+// ports) stay on their own short-lived goroutines.
+type workerPool struct {
+	tasks   chan func()
+	slots   chan struct{} // one token per live worker
+	busy    atomic.Int64  // workers running a task
+	waiting atomic.Int64  // submitters blocked in Go
+}
+
+func newWorkerPool(size int) *workerPool {
+	return &workerPool{tasks: make(chan func()), slots: make(chan struct{}, size)}
+}
+
+// Go hands task to an idle worker, or starts a new one while fewer than size are live, and
+// blocks otherwise. It returns false without running task once ctx is done.
+func (p *workerPool) Go(ctx context.Context, task func()) bool {
+	select {
+	case p.tasks <- task:
+		return true
+	default:
+	}
+	p.waiting.Add(1)
+	defer p.waiting.Add(-1)
+	select {
+	case p.tasks <- task:
+	case p.slots <- struct{}{}:
+		go p.work(task)
+	case <-ctx.Done():
+		return false
+	}
+	return true
+}
+
+func (p *workerPool) work(task func()) {
+	defer func() { <-p.slots }()
+	idle := time.NewTimer(workerIdle)
+	defer idle.Stop()
+	for {
+		p.busy.Add(1)
+		task()
+		p.busy.Add(-1)
+		idle.Reset(workerIdle)
+		select {
+		case task = <-p.tasks:
+		case <-idle.C:
+			return
+		}
+	}
+}
+
+func (p *workerPool) stats() semStats {
+	return semStats{InFlight: p.busy.Load(), Waiting: p.waiting.Load(), Capacity: cap(p.slots)}
+}
+
+// forEach runs fn(i) for every i in [0,n) on probePool and waits for all of them. Once ctx is
+// done the indices not yet handed out are skipped.
+func forEach(ctx context.Context, n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		if !probePool.Go(ctx, func() {
+			defer wg.Done()
+			fn(i)
+		}) {
+			wg.Done()
+			break
+		}
+	}
+	wg.Wait()
+}
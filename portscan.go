@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// portSummary counts the ports of a /api/portscan by state
+type portSummary struct {
+	Open      int `json:"open"`
+	Closed    int `json:"closed"`
+	Filtered  int `json:"filtered"`
+	Unscanned int `json:"unscanned"` // never dialed before the request timeout ran out
+}
+
+// portScanResult is the data of /api/portscan
+type portScanResult struct {
+	IP       string      `json:"ip"`
+	Address  string      `json:"address"` // the address that was dialed
+	From     int         `json:"from"`
+	To       int         `json:"to"`
+	Open     []int       `json:"open"` // ascending
+	Summary  portSummary `json:"summary"`
+	TimedOut bool        `json:"timedout,omitempty"` // the timeout cut the scan short
+}
+
+// parsePortRange reads ?from= and ?to= (to defaults to from), bounded by PORTSCAN_MAX_PORTS
+func parsePortRange(c *gin.Context) (from, to int, err error) {
+	from, err = strconv.Atoi(strings.TrimSpace(c.Query("from")))
+	if err != nil || from < 1 || from > 65535 {
+		return 0, 0, fmt.Errorf("from must be 1-65535")
+	}
+	to = from
+	if v := strings.TrimSpace(c.Query("to")); v != "" {
+		if to, err = strconv.Atoi(v); err != nil || to < from || to > 65535 {
+			return 0, 0, fmt.Errorf("to must be from-65535")
+		}
+	}
+	if n := to - from + 1; n > cfg.PortscanMaxPorts {
+		return 0, 0, fmt.Errorf("port range too large: %d ports (max %d)", n, cfg.PortscanMaxPorts)
+	}
+	return from, to, nil
+}
+
+// scanPort dials one port under semTCP, reporting "" when the scan ran out of time first
+func scanPort(ctx context.Context, dst *net.IPAddr, port int, opts probeOptions) string {
+	if !acquire(ctx, semTCP) {
+		return ""
+	}
+	defer release(semTCP)
+	family := ipFamily(dst.IP)
+	dctx, cancel := context.WithTimeout(ctx, opts.tcpDialTimeout())
+	defer cancel()
+	conn, err := dialTCP(dctx, "tcp"+family, net.JoinHostPort(dst.String(), strconv.Itoa(port)), opts.source(family))
+	if err == nil {
+		_ = conn.Close()
+	} else if ctx.Err() != nil {
+		// The scan's own deadline, not the port's silence, ended this dial
+		return ""
+	}
+	return classifyDial(err)
+}
+
+// handlePortScan serves GET /api/portscan?ip=host&from=1&to=1024, connecting to every port of
+// the range concurrently on the probe pool and summarising open/closed/filtered
+func handlePortScan(c *gin.Context) {
+	input := strings.TrimSpace(c.Query("ip"))
+	if !isValidInput(input) {
+		abortWithError(c, 400, "invalid ip or domain")
+		return
+	}
+	from, to, err := parsePortRange(c)
+	if err != nil {
+		abortWithError(c, 400, err.Error())
+		return
+	}
+	opts, err := parseProbeOptions(c)
+	if err == nil {
+		err = opts.checkTarget(input)
+	}
+	if err != nil {
+		abortWithError(c, 400, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), opts.Timeout)
+	defer cancel()
+	dst, err := resolveTarget(ctx, input, opts)
+	if err != nil {
+		abortWithError(c, 400, err.Error())
+		return
+	}
+
+	states := make([]string, to-from+1)
+	forEach(ctx, len(states), func(i int) {
+		states[i] = scanPort(ctx, dst, from+i, opts)
+	})
+	res := portScanResult{IP: input, Address: dst.String(), From: from, To: to, Open: []int{}}
+	for i, s := range states {
+		switch s {
+		case "open":
+			res.Summary.Open++
+			res.Open = append(res.Open, from+i)
+		case "closed":
+			res.Summary.Closed++
+		case "filtered":
+			res.Summary.Filtered++
+		default:
+			res.Summary.Unscanned++
+		}
+	}
+	res.TimedOut = res.Summary.Unscanned > 0
+	c.JSON(200, apiResponse{Code: 200, Msg: "success", Data: res})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// defaultPprofAddr is where /debug/pprof/ listens when ENABLE_PPROF is set without PPROF_ADDR
+const defaultPprofAddr = "127.0.0.1:6060"
+
+// checkPprofAddr accepts only loopback host:port addresses, so profiles (which expose
+// memory contents and can stall the process) never reach the public listener's audience
+func checkPprofAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("pprof address %q must be on loopback", addr)
+	}
+	return nil
+}
+
+// startPprof serves the net/http/pprof handlers on their own loopback listener, separate from
+// the API server and its middleware. A bind failure is logged, not fatal.
+func startPprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Warn("pprof listener failed", "addr", addr, "err", err)
+		return
+	}
+	slog.Info("pprof listening", "addr", ln.Addr().String())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 2 * time.Second}
+	go func() { _ = srv.Serve(ln) }()
+}
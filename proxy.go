@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// socksDialer carries TCP probes through SOCKS5_PROXY; nil means probes dial directly
+var socksDialer proxy.ContextDialer
+
+// dialTCP connects to addr for a probe: through SOCKS5_PROXY when set, which picks the egress
+// address so src goes unused, and directly from src otherwise
+func dialTCP(ctx context.Context, network, addr string, src net.IP) (net.Conn, error) {
+	if socksDialer != nil {
+		return socksDialer.DialContext(ctx, network, addr)
+	}
+	d := net.Dialer{LocalAddr: dialLocalAddr(network, src), Control: vrfControl}
+	return d.DialContext(ctx, network, addr)
+}
+
+// socksRefused ends the error of a CONNECT the proxy answered with reply 0x05, the target
+// having refused the connection. x/net/proxy has no typed error for it.
+const socksRefused = "unknown error connection refused"
+
+// parseSOCKS5 accepts "host:port" or "socks5://[user:pass@]host[:port]" (port defaults to 1080)
+func parseSOCKS5(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "socks5://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" || u.Hostname() == "" {
+		return nil, fmt.Errorf("socks5 proxy %q must be host:port or socks5://host:port", s)
+	}
+	return u, nil
+}
+
+// setupSOCKS5 installs the dialer for spec, leaving direct dialing in place when it is empty.
+// Only the proxy handshake happens per dial; nothing connects to the proxy at startup.
+func setupSOCKS5(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	u, err := parseSOCKS5(spec)
+	if err != nil {
+		return err
+	}
+	d, err := proxy.FromURL(u, proxy.Direct)
+	if err != nil {
+		return err
+	}
+	socksDialer = d.(proxy.ContextDialer)
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"container/list"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rateLimiter is a per-client token bucket limiter with an LRU-bounded client table
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+	max   int
+
+	mu    sync.Mutex
+	ll    *list.List // front = most recently used
+	items map[string]*list.Element
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst, max int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), max: max, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+// allow takes one token for key, returning the wait until a token is available when denied
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var b *bucket
+	if e, ok := l.items[key]; ok {
+		l.ll.MoveToFront(e)
+		b = e.Value.(*bucket)
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	} else {
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		l.items[key] = l.ll.PushFront(b)
+		// Evict the least recently seen client so spoofed sources can't grow the table
+		for l.ll.Len() > l.max {
+			old := l.ll.Back()
+			l.ll.Remove(old)
+			delete(l.items, old.Value.(*bucket).key)
+		}
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// rateLimitMiddleware rejects clients exceeding rps (with the given burst, default ceil(rps))
+// with 429. Returns nil when rate limiting is disabled.
+func rateLimitMiddleware(rps float64, burst, maxClients int) gin.HandlerFunc {
+	if rps <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rps))
+	}
+	l := newRateLimiter(rps, burst, maxClients)
+	return func(c *gin.Context) {
+		ok, wait := l.allow(clientIP(c), time.Now())
+		if !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			abortWithError(c, 429, "rate limit exceeded")
+			return
+		}
+		c.Next()
+	}
+}
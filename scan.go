@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// scanResult is one host of a /api/scan response
+type scanResult struct {
+	IP        string `json:"ip"`
+	Reachable bool   `json:"reachable"`
+}
+
+// scanHosts expands a CIDR into its host addresses, skipping the IPv4 network and broadcast
+// addresses for prefixes shorter than /31
+func scanHosts(cidr string) ([]netip.Addr, error) {
+	p, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr: %q", cidr)
+	}
+	p = p.Masked()
+	hostBits := p.Addr().BitLen() - p.Bits()
+	// SCAN_MAX_HOSTS defaults to 1024, i.e. an IPv4 /22
+	if hostBits > 30 || 1<<hostBits > cfg.ScanMaxHosts {
+		return nil, fmt.Errorf("cidr too large (max %d addresses)", cfg.ScanMaxHosts)
+	}
+	hosts := make([]netip.Addr, 0, 1<<hostBits)
+	for a := p.Addr(); a.IsValid() && p.Contains(a); a = a.Next() {
+		hosts = append(hosts, a)
+	}
+	if p.Addr().Is4() && hostBits >= 2 {
+		hosts = hosts[1 : len(hosts)-1]
+	}
+	return hosts, nil
+}
+
+// scanHost probes a single address of a scan
+func scanHost(ctx context.Context, h netip.Addr, opts probeOptions) scanResult {
+	res := detectAndPing(ctx, h.String(), opts)
+	return scanResult{IP: h.String(), Reachable: res.reachable()}
+}
+
+// handleScan serves GET /api/scan?cidr=192.168.1.0/24, probing every host concurrently
+func handleScan(c *gin.Context) {
+	hosts, err := scanHosts(strings.TrimSpace(c.Query("cidr")))
+	if err != nil {
+		abortWithError(c, 400, err.Error())
+		return
+	}
+	opts, err := parseProbeOptions(c)
+	if err == nil && len(hosts) > 0 {
+		// Every host of a prefix shares its family
+		err = opts.checkTarget(hosts[0].String())
+	}
+	if err != nil {
+		abortWithError(c, 400, err.Error())
+		return
+	}
+
+	if wantsEventStream(c) {
+		streamEvents(c, len(hosts), func(ctx context.Context, i int) any {
+			return scanHost(ctx, hosts[i], opts)
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	results := make([]scanResult, len(hosts))
+	forEach(ctx, len(hosts), func(i int) {
+		results[i] = scanHost(ctx, hosts[i], opts)
+	})
+	c.JSON(200, apiResponse{Code: 200, Msg: "success", Data: results})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	selftestFlag = flag.Bool("selftest", false, "check ICMP, system ping and DNS, print a report and exit (nonzero when probing can't work)")
+	selftestHost = flag.String("selftest-host", "", "external host -selftest also resolves and probes end to end")
+)
+
+// selftestWait bounds each individual selftest check
+const selftestWait = 3 * time.Second
+
+// selftest prints one line per check and remembers whether a core capability failed
+type selftest struct {
+	w      io.Writer
+	failed bool
+}
+
+func (t *selftest) report(status, name, detail string) {
+	fmt.Fprintf(t.w, "[%-4s] %-16s %s\n", status, name, detail)
+	if status == "FAIL" {
+		t.failed = true
+	}
+}
+
+// runSelftest checks what a deployment needs to probe, without serving HTTP: the ICMP
+// sockets and a loopback echo on each, the system ping, name resolution and, when host is
+// set, a full probe of it. IPv6 problems are warnings; the run fails when nothing can ping
+// IPv4 loopback, resolution is broken or host is unreachable. Returns the exit code.
+func runSelftest(w io.Writer, host string) int {
+	t := &selftest{w: w}
+	loopbackOK := false
+	for _, f := range []struct {
+		family string
+		l      *icmpListener
+		ip     net.IP
+	}{{"4", icmp4, net.IPv4(127, 0, 0, 1)}, {"6", icmp6, net.IPv6loopback}} {
+		name := "icmp" + f.family
+		if f.l == nil {
+			t.report("WARN", name+" socket", "unavailable (needs CAP_NET_RAW or a ping_group_range covering this user)")
+			continue
+		}
+		mode := "raw"
+		if f.l.dgram {
+			mode = "unprivileged datagram"
+		}
+		t.report("OK", name+" socket", mode)
+		ctx, cancel := context.WithTimeout(context.Background(), selftestWait)
+		r, ok := f.l.echo(ctx, &net.IPAddr{IP: f.ip}, nil)
+		cancel()
+		if !ok {
+			t.report("WARN", name+" echo", "no reply from "+f.ip.String())
+			continue
+		}
+		t.report("OK", name+" echo", fmt.Sprintf("%s replied in %.2fms", f.ip, rttMillis(r.rtt)))
+		loopbackOK = loopbackOK || f.family == "4"
+	}
+
+	switch {
+	case cfg.DisableSystemPing:
+		t.report("SKIP", "system ping", "disabled by DISABLE_SYSTEM_PING")
+	case pingPath == "":
+		t.report("WARN", "system ping", cfg.PingBin+" not found")
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), selftestWait)
+		ok := pingWithFamily(ctx, "127.0.0.1", "4")
+		cancel()
+		if ok {
+			t.report("OK", "system ping", pingPath+" reached 127.0.0.1")
+			loopbackOK = true
+		} else {
+			t.report("WARN", "system ping", pingPath+" got no reply from 127.0.0.1")
+		}
+	}
+	if loopbackOK {
+		t.report("OK", "probing", "IPv4 loopback reachable")
+	} else {
+		t.report("FAIL", "probing", "neither ICMP nor the system ping can reach 127.0.0.1")
+	}
+
+	// A domain under test exercises the real resolver; otherwise localhost at least shows the
+	// configured resolver answers
+	name := "localhost"
+	if host != "" && parseIPAddr(host) == nil {
+		name, _ = normalizeDomain(host)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), selftestWait)
+	ips, err := resolver.LookupIP(ctx, "ip", name)
+	cancel()
+	switch {
+	case err != nil:
+		t.report("FAIL", "dns", name+": "+err.Error())
+	case len(ips) == 0:
+		t.report("FAIL", "dns", name+": no addresses")
+	default:
+		t.report("OK", "dns", name+" -> "+strings.Join(ipStrings(ips), ", "))
+	}
+
+	if host != "" {
+		if !isValidInput(host) {
+			t.report("FAIL", "target", "invalid ip or domain: "+host)
+		} else {
+			res := detectAndPing(context.Background(), host, defaultProbeOptions())
+			detail := fmt.Sprintf("%s ipv4:%s ipv6:%s", host, res.IPv4, res.IPv6)
+			if m := strings.Trim(res.IPv4Method+" "+res.IPv6Method, " "); m != "" {
+				detail += " via " + m
+			}
+			if res.Error != "" {
+				detail += " (" + res.Error + ")"
+			}
+			if res.reachable() {
+				t.report("OK", "target", detail)
+			} else {
+				t.report("FAIL", "target", detail)
+			}
+		}
+	}
+
+	if t.failed {
+		fmt.Fprintln(w, "selftest failed")
+		return 1
+	}
+	fmt.Fprintln(w, "selftest passed")
+	return 0
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// isLocalAddr reports whether ip is assigned to one of this host's interfaces
+func isLocalAddr(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSourceAddr validates a probe source address: a literal IP of the given family
+// ("" accepts either) that belongs to a local interface
+func parseSourceAddr(s, family string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source address: %q", s)
+	}
+	if (family == "4" && ip.To4() == nil) || (family == "6" && ip.To4() != nil) {
+		return nil, fmt.Errorf("source address %s is not IPv%s", s, family)
+	}
+	if !isLocalAddr(ip) {
+		return nil, fmt.Errorf("source address %s is not assigned to a local interface", s)
+	}
+	return ip, nil
+}
+
+// ipFamily returns "4" or "6" for ip
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "4"
+	}
+	return "6"
+}
+
+// vrfControl binds probe sockets to the PROBE_VRF device (see setupVRF); nil when unset
+var vrfControl func(network, address string, c syscall.RawConn) error
+
+// listenICMP opens an ICMP socket like icmp.ListenPacket, bound to PROBE_VRF when that is set
+func listenICMP(network, laddr string) (net.PacketConn, error) {
+	if cfg.ProbeVRF != "" {
+		return listenICMPDevice(network, laddr, cfg.ProbeVRF)
+	}
+	c, err := icmp.ListenPacket(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ipv4Conn and ipv6Conn give the per-packet option views of an ICMP socket from listenICMP
+func ipv4Conn(c net.PacketConn) *ipv4.PacketConn {
+	if ic, ok := c.(*icmp.PacketConn); ok {
+		return ic.IPv4PacketConn()
+	}
+	return ipv4.NewPacketConn(c)
+}
+
+func ipv6Conn(c net.PacketConn) *ipv6.PacketConn {
+	if ic, ok := c.(*icmp.PacketConn); ok {
+		return ic.IPv6PacketConn()
+	}
+	return ipv6.NewPacketConn(c)
+}
+
+// dialLocalAddr wraps src as a Dialer.LocalAddr for network ("tcp*" or "udp*"); nil when unset
+func dialLocalAddr(network string, src net.IP) net.Addr {
+	switch {
+	case src == nil:
+		return nil
+	case network[:3] == "udp":
+		return &net.UDPAddr{IP: src}
+	default:
+		return &net.TCPAddr{IP: src}
+	}
+}
+
+// echoListener returns the ICMP listener for family: the shared socket (already bound to the
+// configured source), or a dedicated socket bound to src when a request pins another one or
+// limits the TTL to maxTTL. The returned func releases the dedicated socket.
+func echoListener(family string, src net.IP, maxTTL int) (*icmpListener, func()) {
+	shared := icmp4
+	if family == "6" {
+		shared = icmp6
+	}
+	if maxTTL == 0 && (src == nil || src.Equal(cfg.sourceAddr(family))) {
+		return shared, func() {}
+	}
+	laddr := "0.0.0.0"
+	if family == "6" {
+		laddr = "::"
+	}
+	if src == nil {
+		src = cfg.sourceAddr(family)
+	}
+	if src != nil {
+		laddr = src.String()
+	}
+	l, err := openICMPListener(family, laddr, maxTTL)
+	if err != nil {
+		return nil, func() {}
+	}
+	return l, func() { _ = l.conn.Close() }
+}
+
+// ipv6Usable is false when the host has no global IPv6 address (and FORCE_IPV6 is unset), in
+// which case IPv6 targets are reported not_applicable instead of being probed into a timeout
+var ipv6Usable = true
+
+// hasGlobalIPv6 reports whether any interface carries a global unicast IPv6 address. Unique
+// local addresses count: NAT66/NPTv6 deployments route them out.
+func hasGlobalIPv6() bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return true // can't tell; probing costs less than wrongly hiding a family
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() == nil && n.IP.IsGlobalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
+// needsGlobalIPv6 reports whether none of addrs is reachable without a global IPv6 address,
+// as loopback and link-local ones are
+func needsGlobalIPv6(addrs []string) bool {
+	for _, a := range addrs {
+		host, _, _ := strings.Cut(a, "%")
+		if ip := net.ParseIP(host); ip != nil && (ip.IsLoopback() || ip.IsLinkLocalUnicast()) {
+			return false
+		}
+	}
+	return true
+}
+
+// setupIPv6 decides once at startup whether IPv6 probes can succeed on this host
+func setupIPv6() {
+	if cfg.ForceIPv6 || hasGlobalIPv6() {
+		return
+	}
+	ipv6Usable = false
+	slog.Info("no global IPv6 address on this host, IPv6 probes disabled (FORCE_IPV6=1 overrides)")
+}
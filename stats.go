@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// semaphore caps concurrent operations of one kind and tracks how many hold or await a slot
+type semaphore struct {
+	slots    chan struct{}
+	inflight atomic.Int64
+	waiting  atomic.Int64
+}
+
+func newSemaphore(n int) *semaphore {
+	return &semaphore{slots: make(chan struct{}, n)}
+}
+
+// saturated reports whether every slot is taken
+func (s *semaphore) saturated() bool { return len(s.slots) == cap(s.slots) }
+
+// acquire takes a slot of sem, waiting until ctx is done. Under backpressureMiddleware the wait
+// is capped at acquireTimeout, after which the whole request is shed.
+func acquire(ctx context.Context, sem *semaphore) bool {
+	sem.waiting.Add(1)
+	defer sem.waiting.Add(-1)
+	var timeout <-chan time.Time
+	if acquireTimeout > 0 && ctx.Value(shedKey{}) != nil {
+		t := time.NewTimer(acquireTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case sem.slots <- struct{}{}:
+		sem.inflight.Add(1)
+		return true
+	case <-ctx.Done():
+		return false
+	case <-timeout:
+		shed(ctx, sem)
+		return false
+	}
+}
+
+func release(sem *semaphore) {
+	sem.inflight.Add(-1)
+	<-sem.slots
+}
+
+var (
+	startTime      = time.Now()
+	requestsServed atomic.Uint64 // completed HTTP requests, counted by requestLogger
+)
+
+// semStats is one semaphore's entry in /api/stats
+type semStats struct {
+	InFlight int64 `json:"in_flight"`
+	Waiting  int64 `json:"waiting"` // callers blocked in acquire (queue depth)
+	Capacity int   `json:"capacity"`
+}
+
+// serverStats is the data of /api/stats
+type serverStats struct {
+	Semaphores     map[string]semStats `json:"semaphores"`
+	Workers        semStats            `json:"workers"`            // probe pool: busy workers, blocked submitters, MAX_WORKERS
+	Requests       *semStats           `json:"requests,omitempty"` // probe requests admitted under MAX_INFLIGHT_REQUESTS
+	ICMP           icmpStats           `json:"icmp"`
+	RequestsServed uint64              `json:"requests_served"`
+	UptimeSeconds  float64             `json:"uptime_seconds"`
+}
+
+// requestStats reports the request cap's usage, nil when MAX_INFLIGHT_REQUESTS is unset
+func requestStats() *semStats {
+	if semRequests == nil {
+		return nil
+	}
+	st := semRequests.stats()
+	return &st
+}
+
+// icmpStats describes echo (ID, Seq) allocation on the shared ICMP sockets
+type icmpStats struct {
+	EchoesSent  uint32 `json:"echoes_sent"` // the sequence counter: echoes allocated since start (wraps at 2^32)
+	Outstanding int    `json:"outstanding"` // echoes awaiting a reply, both families
+	SeqSkips    uint64 `json:"seq_skips"`   // pairs skipped after wraparound because their earlier echo was outstanding
+}
+
+func (s *semaphore) stats() semStats {
+	return semStats{InFlight: s.inflight.Load(), Waiting: s.waiting.Load(), Capacity: cap(s.slots)}
+}
+
+// handleStats serves GET /api/stats with semaphore usage, request count and uptime
+func handleStats(c *gin.Context) {
+	c.JSON(200, apiResponse{Code: 200, Msg: "success", Data: serverStats{
+		Semaphores: map[string]semStats{
+			"dns":  semDNS.stats(),
+			"icmp": semICMP.stats(),
+			"tcp":  semTCP.stats(),
+			"udp":  semUDP.stats(),
+		},
+		Workers:  probePool.stats(),
+		Requests: requestStats(),
+		ICMP: icmpStats{
+			EchoesSent:  echoSeq.Load(),
+			Outstanding: icmp4.outstanding() + icmp6.outstanding(),
+			SeqSkips:    echoSeqSkips.Load(),
+		},
+		RequestsServed: requestsServed.Load(),
+		UptimeSeconds:  float64(time.Since(startTime).Milliseconds()) / 1000,
+	}})
+}
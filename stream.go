@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// wantsEventStream reports whether the client asked for SSE (?stream=1 or Accept: text/event-stream)
+func wantsEventStream(c *gin.Context) bool {
+	return c.Query("stream") == "1" || strings.Contains(c.GetHeader("Accept"), "text/event-stream")
+}
+
+// streamEvents runs probe(i) for every i in [0,n) concurrently on the probe pool and flushes each result as an
+// SSE "result" event as soon as it completes, then a final "done" event with the count and how
+// many results failed. A client disconnect cancels the request context, which stops the
+// outstanding probes.
+func streamEvents(c *gin.Context, n int, probe func(ctx context.Context, i int) any) {
+	ctx := c.Request.Context()
+	results := make(chan any, n)
+	go forEach(ctx, n, func(i int) { results <- probe(ctx, i) })
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	rc := http.NewResponseController(c.Writer)
+	remaining, s := n, batchSummary{Count: n}
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case v := <-results:
+			// Long scans would otherwise hit the server-wide WriteTimeout
+			_ = rc.SetWriteDeadline(time.Now().Add(maxProbeTimeout + 2*time.Second))
+			c.SSEvent("result", v)
+			if failed(v) {
+				s.Errors++
+			}
+			if remaining--; remaining == 0 {
+				c.SSEvent("done", s)
+				return false
+			}
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+}
+
+// streamNDJSON is streamEvents for pipelines: each result is written as one JSON line
+// (application/x-ndjson) and flushed as soon as it completes, in completion order. It returns
+// the summary of what was written and whether every result was, for the caller's trailer.
+func streamNDJSON(c *gin.Context, n int, probe func(ctx context.Context, i int) any) (batchSummary, bool) {
+	ctx := c.Request.Context()
+	results := make(chan any, n)
+	go forEach(ctx, n, func(i int) { results <- probe(ctx, i) })
+
+	c.Header("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(c.Writer)
+	return writeStream(c, results, n, enc.Encode)
+}
+
+// streamCSV is streamNDJSON for spreadsheets: a csvHeader row, then one CSV record per result in
+// completion order, then a trailer row "#done,count=<n>,errors=<e>" padded to the header's width
+// once every result is written. Nothing is buffered beyond the record being written.
+func streamCSV(c *gin.Context, n int, probe func(ctx context.Context, i int) batchResult) {
+	ctx := c.Request.Context()
+	results := make(chan batchResult, n)
+	go forEach(ctx, n, func(i int) { results <- probe(ctx, i) })
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	w := csv.NewWriter(c.Writer)
+	if w.Write(csvHeader) != nil {
+		return
+	}
+	flush := func(rec []string) error {
+		_ = w.Write(rec)
+		w.Flush()
+		return w.Error()
+	}
+	s, done := writeStream(c, results, n, func(r batchResult) error {
+		return flush(r.csvRecord(r.Input))
+	})
+	if done {
+		trailer := make([]string, len(csvHeader))
+		trailer[0], trailer[1], trailer[2] = "#done", fmt.Sprintf("count=%d", s.Count), fmt.Sprintf("errors=%d", s.Errors)
+		_ = flush(trailer)
+	}
+}
+
+// failed reports whether v is a result that failed (see batchResult.failed)
+func failed(v any) bool {
+	f, ok := v.(interface{ failed() bool })
+	return ok && f.failed()
+}
+
+// writeStream sends the 200 status, then passes each of the n results to write as it arrives,
+// flushing after every one, until all are written, a write fails or the client goes away. It
+// returns the summary of the results written and whether that was all n.
+func writeStream[T any](c *gin.Context, results <-chan T, n int, write func(T) error) (batchSummary, bool) {
+	ctx := c.Request.Context()
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+	rc := http.NewResponseController(c.Writer)
+	var s batchSummary
+	for remaining := n; remaining > 0; remaining-- {
+		select {
+		case v := <-results:
+			_ = rc.SetWriteDeadline(time.Now().Add(maxProbeTimeout + 2*time.Second))
+			if write(v) != nil {
+				return s, false
+			}
+			_ = rc.Flush()
+			s.Count++
+			if failed(v) {
+				s.Errors++
+			}
+		case <-ctx.Done():
+			return s, false
+		}
+	}
+	return s, true
+}
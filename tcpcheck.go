@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tcpPortResult is the data of /api/tcp
+type tcpPortResult struct {
+	IP      string  `json:"ip"`
+	Address string  `json:"address"` // the address that was dialed
+	Port    int     `json:"port"`
+	State   string  `json:"state"`            // "open", "closed" or "filtered"
+	RTTms   float64 `json:"rtt_ms,omitempty"` // time to SYN-ACK (open) or RST (closed)
+	Error   string  `json:"error,omitempty"`
+}
+
+// classifyDial maps a dial outcome to nmap-style port states: a completed handshake is open,
+// a RST (connection refused) is closed, and silence or an ICMP unreachable is filtered. Through
+// SOCKS5_PROXY the target's RST only shows as the proxy's "connection refused" reply; any other
+// failure, the proxy itself refusing us included, is filtered.
+func classifyDial(err error) string {
+	switch {
+	case err == nil:
+		return "open"
+	case socksDialer != nil:
+		if strings.HasSuffix(err.Error(), socksRefused) {
+			return "closed"
+		}
+		return "filtered"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "closed"
+	default:
+		return "filtered"
+	}
+}
+
+// resolveTarget returns the literal IP input or the first address it resolves to, preferring
+// IPv4, within ?family=
+func resolveTarget(ctx context.Context, input string, opts probeOptions) (*net.IPAddr, error) {
+	if dst := parseIPAddr(input); dst != nil {
+		return dst, nil
+	}
+	v4, v6, _, _ := resolveFamilies(ctx, opts.resolver(), input, opts.Family)
+	switch {
+	case len(v4) > 0:
+		return &net.IPAddr{IP: v4[0]}, nil
+	case len(v6) > 0:
+		return &net.IPAddr{IP: v6[0]}, nil
+	}
+	return nil, errors.New("dns: no address for " + input)
+}
+
+// handleTCPCheck serves GET /api/tcp?ip=host&port=22, reporting open/closed/filtered
+func handleTCPCheck(c *gin.Context) {
+	input := strings.TrimSpace(c.Query("ip"))
+	if !isValidInput(input) {
+		abortWithError(c, 400, "invalid ip or domain")
+		return
+	}
+	port, err := strconv.Atoi(c.Query("port"))
+	if err != nil || port < 1 || port > 65535 {
+		abortWithError(c, 400, "port must be 1-65535")
+		return
+	}
+	opts, err := parseProbeOptions(c)
+	if err == nil {
+		err = opts.checkTarget(input)
+	}
+	if err != nil {
+		abortWithError(c, 400, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), opts.Timeout)
+	defer cancel()
+	dst, err := resolveTarget(ctx, input, opts)
+	if err != nil {
+		abortWithError(c, 400, err.Error())
+		return
+	}
+
+	if !acquire(ctx, semTCP) {
+		abortCancelled(c, ctx, "tcp check")
+		return
+	}
+	defer release(semTCP)
+	family := ipFamily(dst.IP)
+	addr := net.JoinHostPort(dst.String(), strconv.Itoa(port))
+	start := time.Now()
+	conn, err := dialTCP(ctx, "tcp"+family, addr, opts.source(family))
+	rtt := time.Since(start)
+	res := tcpPortResult{IP: input, Port: port, State: classifyDial(err), Address: addr}
+	if res.State != "filtered" {
+		res.RTTms = rttMillis(rtt)
+	}
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		_ = conn.Close()
+	}
+	c.JSON(200, apiResponse{Code: 200, Msg: "success", Data: res})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"time"
+)
+
+// tlsReport holds per-family certificate details (tls=1)
+type tlsReport struct {
+	IPv4 *tlsInfo `json:"ipv4,omitempty"`
+	IPv6 *tlsInfo `json:"ipv6,omitempty"`
+}
+
+// tlsInfo describes the certificate served on port 443. Connect and handshake failures are
+// reported separately so an expired or misconfigured cert isn't mistaken for a closed port.
+type tlsInfo struct {
+	Address        string   `json:"address,omitempty"`
+	Version        string   `json:"version,omitempty"`
+	Subject        string   `json:"subject,omitempty"`
+	Issuer         string   `json:"issuer,omitempty"`
+	SANs           []string `json:"sans,omitempty"`
+	NotAfter       string   `json:"not_after,omitempty"`
+	Expired        bool     `json:"expired,omitempty"`
+	ConnectError   string   `json:"connect_error,omitempty"`
+	HandshakeError string   `json:"handshake_error,omitempty"`
+}
+
+// inspectTLS connects to the first of addrs accepting on 443 and performs a TLS handshake
+// without verification, so self-signed and expired certificates still report.
+func inspectTLS(ctx context.Context, addrs []string, family, serverName string, timeout time.Duration, src net.IP) *tlsInfo {
+	if len(addrs) == 0 {
+		return nil
+	}
+	if !acquire(ctx, semTCP) {
+		return &tlsInfo{ConnectError: ctx.Err().Error()}
+	}
+	defer release(semTCP)
+
+	var conn net.Conn
+	var addr string
+	var err error
+	for _, a := range addrs {
+		addr = net.JoinHostPort(a, "443")
+		dctx, cancel := context.WithTimeout(ctx, timeout)
+		conn, err = dialTCP(dctx, "tcp"+family, addr, src)
+		cancel()
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return &tlsInfo{ConnectError: err.Error()}
+	}
+	defer conn.Close()
+
+	// Through SOCKS5_PROXY the connection's remote address is the proxy's
+	info := &tlsInfo{Address: addr}
+	tc := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	hctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := tc.HandshakeContext(hctx); err != nil {
+		info.HandshakeError = err.Error()
+		return info
+	}
+	st := tc.ConnectionState()
+	info.Version = tls.VersionName(st.Version)
+	if len(st.PeerCertificates) > 0 {
+		fillCertInfo(info, st.PeerCertificates[0])
+	}
+	return info
+}
+
+// fillCertInfo copies the leaf certificate's identity and validity into info
+func fillCertInfo(info *tlsInfo, cert *x509.Certificate) {
+	info.Subject = cert.Subject.String()
+	info.Issuer = cert.Issuer.String()
+	info.SANs = append(info.SANs, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+	info.NotAfter = cert.NotAfter.UTC().Format(time.RFC3339)
+	info.Expired = time.Now().After(cert.NotAfter)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	maxTraceHops = 30
+	traceHopWait = 2 * time.Second
+
+	defaultMTRRounds = 5
+	maxMTRRounds     = 10
+)
+
+// traceHop is one line of /api/traceroute output
+type traceHop struct {
+	Hop   int     `json:"hop"`
+	IP    string  `json:"ip,omitempty"`
+	Host  string  `json:"host,omitempty"`
+	RTTms float64 `json:"rtt_ms"` // -1 when the hop didn't answer
+}
+
+// mtrHop is one line of /api/mtr output: per-TTL statistics over several rounds
+type mtrHop struct {
+	Hop  int       `json:"hop"`
+	IP   string    `json:"ip,omitempty"` // last address that answered at this TTL
+	Host string    `json:"host,omitempty"`
+	Sent int       `json:"sent"`
+	Loss *float64  `json:"loss_percent"`
+	RTT  *rttStats `json:"rtt,omitempty"` // nil when the hop never answered
+}
+
+// handleTraceroute serves GET /api/traceroute?ip=target&family=4|6
+func handleTraceroute(c *gin.Context) {
+	dst, maxHops, ok := traceTarget(c)
+	if !ok {
+		return
+	}
+	hops, err := traceroute(c.Request.Context(), dst, maxHops)
+	if err != nil {
+		abortWithError(c, 500, err.Error())
+		return
+	}
+	c.JSON(200, apiResponse{Code: 200, Msg: "success", Data: hops})
+}
+
+// handleMTR serves GET /api/mtr?ip=target&family=4|6&count=5: traceroute repeated count times,
+// reporting loss and RTT statistics per hop
+func handleMTR(c *gin.Context) {
+	rounds := defaultMTRRounds
+	if v := c.Query("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxMTRRounds {
+			abortWithError(c, 400, "count must be 1-"+strconv.Itoa(maxMTRRounds))
+			return
+		}
+		rounds = n
+	}
+	dst, maxHops, ok := traceTarget(c)
+	if !ok {
+		return
+	}
+	hops, err := mtr(c.Request.Context(), dst, maxHops, rounds)
+	if err != nil {
+		abortWithError(c, 500, err.Error())
+		return
+	}
+	c.JSON(200, apiResponse{Code: 200, Msg: "success", Data: hops})
+}
+
+// traceTarget validates the ip/family/maxhops query shared by traceroute and mtr and resolves
+// the destination, writing a 400 and returning ok=false when the request is unusable
+func traceTarget(c *gin.Context) (dst *net.IPAddr, maxHops int, ok bool) {
+	input := strings.TrimSpace(c.Query("ip"))
+	if !isValidInput(input) {
+		abortWithError(c, 400, "invalid ip or domain")
+		return nil, 0, false
+	}
+	family := c.DefaultQuery("family", "4")
+	if family != "4" && family != "6" {
+		abortWithError(c, 400, "family must be 4 or 6")
+		return nil, 0, false
+	}
+	maxHops = maxTraceHops
+	if v := c.Query("maxhops"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTraceHops {
+			abortWithError(c, 400, "maxhops must be 1-30")
+			return nil, 0, false
+		}
+		maxHops = n
+	}
+
+	// Literal IPs imply their own family; domains resolve the requested one
+	ctx := c.Request.Context()
+	dst = parseIPAddr(input)
+	if dst == nil {
+		host, _ := normalizeDomain(input)
+		var ips []net.IP
+		if acquire(ctx, semDNS) {
+			ips, _ = resolver.LookupIP(ctx, "ip"+family, host)
+			release(semDNS)
+		}
+		if len(ips) == 0 {
+			abortWithError(c, 400, "dns: no address for family "+family)
+			return nil, 0, false
+		}
+		dst = &net.IPAddr{IP: ips[0]}
+	}
+	return dst, maxHops, true
+}
+
+// traceSocket is a dedicated ICMP socket for TTL-limited echoes to one destination
+type traceSocket struct {
+	conn     net.PacketConn
+	dst      *net.IPAddr
+	v4       bool
+	proto    int
+	echoType icmp.Type
+	id       int
+}
+
+// hopReply is the answer one TTL got in a round
+type hopReply struct {
+	ip  net.IP
+	rtt time.Duration
+}
+
+// openTraceSocket opens a raw ICMP socket for dst's family. A cancelled ctx closes it, which
+// unblocks any read rather than making rounds poll ctx; the returned func releases it.
+func openTraceSocket(ctx context.Context, dst *net.IPAddr) (*traceSocket, func(), error) {
+	id, _ := nextEcho()
+	t := &traceSocket{dst: dst, v4: dst.IP.To4() != nil, proto: 58, echoType: ipv6.ICMPTypeEchoRequest, id: id}
+	network, laddr := "ip6:ipv6-icmp", "::"
+	if t.v4 {
+		network, laddr, t.proto, t.echoType = "ip4:icmp", "0.0.0.0", 1, ipv4.ICMPTypeEcho
+	}
+	conn, err := listenICMP(network, laddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.conn = conn
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	return t, func() {
+		stop()
+		_ = conn.Close()
+	}, nil
+}
+
+// round sends one echo per TTL (1..maxHops) in a burst and collects Time Exceeded / Echo Reply
+// answers for up to traceHopWait. replies is indexed by TTL (nil ip = no answer); reached is
+// the lowest TTL the destination itself answered, maxHops+1 if none did.
+func (t *traceSocket) round(ctx context.Context, maxHops int) (replies []hopReply, reached int, err error) {
+	seqTTL := make(map[int]int, maxHops)
+	sent := make([]time.Time, maxHops+1)
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		if t.v4 {
+			err = ipv4Conn(t.conn).SetTTL(ttl)
+		} else {
+			err = ipv6Conn(t.conn).SetHopLimit(ttl)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		seq := int(echoSeq.Add(1) & 0xffff)
+		seqTTL[seq] = ttl
+		b, err := (&icmp.Message{Type: t.echoType, Body: &icmp.Echo{ID: t.id, Seq: seq, Data: []byte("trace")}}).Marshal(nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		sent[ttl] = time.Now()
+		if _, err := t.conn.WriteTo(b, t.dst); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	deadline := time.Now().Add(traceHopWait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = t.conn.SetReadDeadline(deadline)
+
+	replies = make([]hopReply, maxHops+1)
+	reached = maxHops + 1
+	bp := readBufs.Get().(*[]byte)
+	defer readBufs.Put(bp)
+	buf := *bp
+	for pending := maxHops; pending > 0; {
+		n, peer, err := t.conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		at := time.Now()
+		rm, err := icmp.ParseMessage(t.proto, buf[:n])
+		if err != nil {
+			continue
+		}
+		var seq int
+		switch body := rm.Body.(type) {
+		case *icmp.Echo:
+			if rm.Type != ipv4.ICMPTypeEchoReply && rm.Type != ipv6.ICMPTypeEchoReply || body.ID != t.id {
+				continue
+			}
+			seq = body.Seq
+		case *icmp.TimeExceeded:
+			eid, eseq, ok := innerEcho(t.proto, body.Data)
+			if !ok || eid != t.id {
+				continue
+			}
+			seq = eseq
+		default:
+			continue
+		}
+		// Answers to an earlier round carry sequence numbers this round doesn't know
+		ttl, ok := seqTTL[seq]
+		if !ok || replies[ttl].ip != nil {
+			continue
+		}
+		replies[ttl] = hopReply{ip: peerIP(peer), rtt: at.Sub(sent[ttl])}
+		pending--
+		if _, isEcho := rm.Body.(*icmp.Echo); isEcho && ttl < reached {
+			reached = ttl
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, 0, ctx.Err()
+	}
+	return replies, reached, nil
+}
+
+// traceroute sends one echo per TTL (1..maxHops) in a burst on a dedicated socket and
+// collects Time Exceeded / Echo Reply answers for up to traceHopWait.
+func traceroute(ctx context.Context, dst *net.IPAddr, maxHops int) ([]traceHop, error) {
+	t, closeSocket, err := openTraceSocket(ctx, dst)
+	if err != nil {
+		return nil, err
+	}
+	defer closeSocket()
+	replies, reached, err := t.round(ctx, maxHops)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hops past the destination just echo it again; cut the path there
+	last := min(reached, maxHops)
+	out := make([]traceHop, 0, last)
+	ips := make([]string, 0, last)
+	for ttl := 1; ttl <= last; ttl++ {
+		h := traceHop{Hop: ttl, RTTms: -1}
+		if r := replies[ttl]; r.ip != nil {
+			h.IP, h.RTTms = r.ip.String(), rttMillis(r.rtt)
+		}
+		out = append(out, h)
+		ips = append(ips, h.IP)
+	}
+	for i, name := range resolveHopNames(ctx, ips) {
+		out[i].Host = name
+	}
+	return out, nil
+}
+
+// mtr runs rounds traceroute bursts back to back on one socket and aggregates every TTL's
+// answers into loss and RTT statistics. The path is cut at the lowest TTL where the
+// destination answered in any round.
+func mtr(ctx context.Context, dst *net.IPAddr, maxHops, rounds int) ([]mtrHop, error) {
+	t, closeSocket, err := openTraceSocket(ctx, dst)
+	if err != nil {
+		return nil, err
+	}
+	defer closeSocket()
+
+	stats := make([]echoStats, maxHops+1)
+	last := make([]net.IP, maxHops+1)
+	reached := maxHops + 1
+	for range rounds {
+		replies, r, err := t.round(ctx, maxHops)
+		if err != nil {
+			return nil, err
+		}
+		reached = min(reached, r)
+		for ttl := 1; ttl <= maxHops; ttl++ {
+			stats[ttl].Sent++
+			if rep := replies[ttl]; rep.ip != nil {
+				stats[ttl].RTTs = append(stats[ttl].RTTs, rep.rtt)
+				last[ttl] = rep.ip
+			}
+		}
+	}
+
+	n := min(reached, maxHops)
+	out := make([]mtrHop, 0, n)
+	ips := make([]string, 0, n)
+	for ttl := 1; ttl <= n; ttl++ {
+		h := mtrHop{Hop: ttl, Sent: stats[ttl].Sent, Loss: stats[ttl].lossPercent(), RTT: stats[ttl].summary()}
+		if last[ttl] != nil {
+			h.IP = last[ttl].String()
+		}
+		out = append(out, h)
+		ips = append(ips, h.IP)
+	}
+	for i, name := range resolveHopNames(ctx, ips) {
+		out[i].Host = name
+	}
+	return out, nil
+}
+
+// resolveHopNames looks up a PTR name for each non-empty hop address (best effort, short
+// timeout); names[i] is "" when ips[i] is empty or has none
+func resolveHopNames(ctx context.Context, ips []string) []string {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	names := make([]string, len(ips))
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		if ip == "" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !acquire(ctx, semDNS) {
+				return
+			}
+			defer release(semDNS)
+			if ptr, err := netResolver.LookupAddr(ctx, ip); err == nil && len(ptr) > 0 {
+				names[i] = strings.TrimSuffix(ptr[0], ".")
+			}
+		}()
+	}
+	wg.Wait()
+	return names
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records probe spans. Until setupTracing installs a provider it is the global no-op,
+// so instrumented code costs next to nothing when tracing is off.
+var tracer = otel.Tracer("ip")
+
+// setupTracing exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT (or the
+// traces-specific variant) is set; the exporter reads the standard OTEL_* variables itself.
+// The returned func flushes and stops the exporter; it is a no-op when tracing is disabled.
+func setupTracing(ctx context.Context) func(context.Context) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) {}
+	}
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		slog.Warn("tracing disabled, exporter setup failed", "err", err)
+		return func(context.Context) {}
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	slog.Info("tracing enabled")
+	return func(ctx context.Context) {
+		if err := tp.Shutdown(ctx); err != nil {
+			slog.Warn("tracing shutdown incomplete", "err", err)
+		}
+	}
+}
+
+// tracingMiddleware continues the caller's trace from its traceparent header and wraps the
+// request in a server span, so probe spans nest under it. Returns nil when tracing is off.
+func tracingMiddleware() gin.HandlerFunc {
+	if _, ok := otel.GetTracerProvider().(*sdktrace.TracerProvider); !ok {
+		return nil
+	}
+	prop := otel.GetTextMapPropagator()
+	return func(c *gin.Context) {
+		ctx := prop.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		ctx, span := tracer.Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("http.route", route),
+			))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, strconv.Itoa(status))
+		}
+	}
+}
+
+// familyAttr is the span attribute for an address family ("4", "6"; "both" when unrestricted)
+func familyAttr(family string) attribute.KeyValue {
+	if family == "" {
+		family = "both"
+	}
+	return attribute.String("family", family)
+}
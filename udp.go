@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// udpPayload returns a datagram likely to draw a reply from a service on port
+func udpPayload(port string) []byte {
+	switch port {
+	case "53":
+		// DNS query: ID 0x1234, RD set, QDCOUNT 1, root name, type NS, class IN
+		return []byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x01}
+	case "123":
+		// NTPv3 client request
+		b := make([]byte, 48)
+		b[0] = 0x1b
+		return b
+	}
+	return []byte("ping")
+}
+
+// udpConnectRace sends a small datagram to each IP/port; any reply or ICMP port-unreachable
+// (surfaced as ECONNREFUSED on the connected socket) proves the host is alive. Reports the
+// port that answered. Datagrams originate from src when set.
+func udpConnectRace(ctx context.Context, ips []net.IP, family string, ports []string, window time.Duration, src net.IP) (string, bool) {
+	if len(ports) == 0 {
+		return "", false
+	}
+	ctx2, cancel := context.WithTimeout(ctx, window)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	done := make(chan string, 1)
+	var once sync.Once
+
+	dialNet := "udp4"
+	if family == "6" {
+		dialNet = "udp6"
+	}
+
+	for _, ip := range ips {
+		for _, p := range ports {
+			goSafe(ctx2, &wg, func() {
+				if !acquire(ctx2, semUDP) {
+					return
+				}
+				defer release(semUDP)
+				if udpProbe(ctx2, dialNet, net.JoinHostPort(ip.String(), p), udpPayload(p), src) {
+					once.Do(func() { done <- p })
+				}
+			})
+		}
+	}
+
+	select {
+	case p := <-done:
+		return p, true
+	case <-ctx2.Done():
+		return "", false
+	}
+}
+
+// udpProbe reports whether addr answered the payload or rejected it with port-unreachable
+func udpProbe(ctx context.Context, network, addr string, payload []byte, src net.IP) bool {
+	d := net.Dialer{LocalAddr: dialLocalAddr(network, src), Control: vrfControl}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	// Unblock the read as soon as the race is decided
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(payload); err != nil {
+		return false
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err == nil {
+		return n > 0
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
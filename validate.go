@@ -0,0 +1,37 @@
+package main
+
+import "github.com/gin-gonic/gin"
+
+// inputCheck explains how an input fares against the probe endpoints' rules
+type inputCheck struct {
+	Valid      bool   `json:"valid"`
+	Kind       string `json:"kind,omitempty"`       // "ipv4", "ipv6" or "domain"
+	Normalized string `json:"normalized,omitempty"` // canonical IP or IDNA ASCII (punycode) name
+	Reason     string `json:"reason,omitempty"`     // why an invalid input was rejected
+}
+
+// checkInput applies the rules behind isValidInput and reports the outcome
+func checkInput(s string) inputCheck {
+	switch {
+	case s == "":
+		return inputCheck{Reason: "empty input"}
+	case len(s) > 255:
+		return inputCheck{Reason: "input longer than 255 characters"}
+	}
+	if a := parseIPAddr(s); a != nil {
+		if a.Zone != "" && !validZone(a.Zone) {
+			return inputCheck{Kind: "ipv6", Reason: "unknown interface zone " + a.Zone}
+		}
+		return inputCheck{Valid: true, Kind: "ipv" + ipFamily(a.IP), Normalized: a.String()}
+	}
+	ascii, ok := normalizeDomain(s)
+	if !ok {
+		return inputCheck{Reason: "not an IP address or valid domain name"}
+	}
+	return inputCheck{Valid: true, Kind: "domain", Normalized: ascii}
+}
+
+// handleValidate serves GET /api/validate?ip=input: the verdict and normalized form, without probing
+func handleValidate(c *gin.Context) {
+	c.JSON(200, apiResponse{Code: 200, Msg: "success", Data: checkInput(pingInput(c))})
+}
@@ -0,0 +1,84 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"syscall"
+)
+
+// setupVRF checks the PROBE_VRF device and makes probe dialers bind their sockets to it, so
+// probes follow that VRF's routing table instead of the main one
+func setupVRF() {
+	dev := cfg.ProbeVRF
+	if dev == "" {
+		return
+	}
+	if _, err := net.InterfaceByName(dev); err != nil {
+		fatal("invalid PROBE_VRF", "device", dev, "err", err)
+	}
+	vrfControl = func(_, _ string, c syscall.RawConn) error {
+		return bindToDevice(c, dev)
+	}
+	slog.Info("probing via vrf", "device", dev)
+}
+
+// bindToDevice sets SO_BINDTODEVICE on c
+func bindToDevice(c syscall.RawConn, dev string) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, dev)
+	}); err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("binding to %s: %w", dev, serr)
+	}
+	return nil
+}
+
+// listenICMPDevice opens an ICMP socket as icmp.ListenPacket would, bound to dev before its
+// local address. Raw sockets ("ip4:icmp", "ip6:ipv6-icmp") go through net.ListenConfig;
+// unprivileged datagram ones ("udp4", "udp6") are not a network the net package can open, so
+// the socket is made directly and handed over as a file.
+func listenICMPDevice(network, laddr, dev string) (net.PacketConn, error) {
+	if network != "udp4" && network != "udp6" {
+		lc := net.ListenConfig{Control: func(_, _ string, c syscall.RawConn) error { return bindToDevice(c, dev) }}
+		return lc.ListenPacket(context.Background(), network, laddr)
+	}
+	ip := net.ParseIP(laddr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid icmp listen address %q", laddr)
+	}
+	var sa syscall.Sockaddr
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	if network == "udp6" {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+		sa6 := &syscall.SockaddrInet6{}
+		copy(sa6.Addr[:], ip.To16())
+		sa = sa6
+	} else {
+		sa4 := &syscall.SockaddrInet4{}
+		copy(sa4.Addr[:], ip.To4())
+		sa = sa4
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, dev); err != nil {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("binding to %s: %w", dev, err)
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		_ = syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	f := os.NewFile(uintptr(fd), "icmp")
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
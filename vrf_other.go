@@ -0,0 +1,22 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+)
+
+// setupVRF ignores PROBE_VRF: binding sockets to a VRF device is Linux-only
+func setupVRF() {
+	if cfg.ProbeVRF != "" {
+		slog.Warn("PROBE_VRF is only supported on Linux, ignoring", "device", cfg.ProbeVRF)
+		cfg.ProbeVRF = ""
+	}
+}
+
+// listenICMPDevice is never reached, as setupVRF clears PROBE_VRF
+func listenICMPDevice(string, string, string) (net.PacketConn, error) {
+	return nil, errors.ErrUnsupported
+}